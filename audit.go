@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// auditRecord describes a command run by the archive, so that incident
+// response can reconstruct what an artifact ran on a host.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Archive string    `json:"archive"`
+	Key     string    `json:"key"`
+	Dir     string    `json:"dir"`
+	Command []string  `json:"command"`
+	// SHA256 is the digest of the command and its arguments, separated by
+	// NUL bytes.
+	SHA256 string `json:"sha256"`
+}
+
+// recordAudit appends a record of the command about to be run, after all
+// substitutions, to the file set in the environment, if any.
+func (se *selfExtractor) recordAudit(argv []string) {
+	path := os.Getenv(EnvAuditFile)
+	if path == "" {
+		return
+	}
+
+	exePath, _ := executable()
+	sum := sha256.Sum256([]byte(strings.Join(argv, "\x00")))
+	data, err := json.Marshal(auditRecord{
+		Time:    clock.Now().UTC(),
+		Archive: exePath,
+		Key:     hex.EncodeToString(se.key),
+		Dir:     se.extractDir,
+		Command: argv,
+		SHA256:  hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		warn("encoding audit record:", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		warn("opening audit file:", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		warn("writing audit file:", err)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "strings"
+
+const capabilitiesMarkerLen = 17
+
+// capabilities lists what the payloads the stub extracts may use, so that an
+// archive isn't created with a stub that couldn't extract it: rewrap -stub
+// looks for the marker in the stub to find them. The list ends with a NUL
+// byte, and is only extended, never reordered. Stubs built with the stubonly
+// tag leave out the codecs other than zstd.
+var capabilities = "SELFEXTRACT-CAPS:" +
+	"zstd," + extraCodecCapabilities + "none,long,encrypted,hardlink,xattr,encrypted-files\x00"
+
+// capabilityList returns the capabilities of this stub, as a comma-separated
+// list. Printing it with the version also keeps the marker in stubs built
+// without the creation code.
+func capabilityList() string {
+	return strings.TrimSuffix(capabilities[capabilitiesMarkerLen:], "\x00")
+}
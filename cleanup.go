@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxReportedPaths limits the number of paths listed in a cleanupError.
+const maxReportedPaths = 10
+
+// cleanupError lists the paths that could not be removed during a cleanup.
+type cleanupError struct {
+	paths []string
+	err   error // first error encountered
+}
+
+func (e *cleanupError) Error() string {
+	paths := e.paths
+	more := ""
+	if len(paths) > maxReportedPaths {
+		more = fmt.Sprintf(" and %d more", len(paths)-maxReportedPaths)
+		paths = paths[:maxReportedPaths]
+	}
+	return fmt.Sprintf("could not remove %s%s: %v", strings.Join(paths, ", "), more, e.err)
+}
+
+func (e *cleanupError) Unwrap() error {
+	return e.err
+}
+
+// removeAll is like os.RemoveAll, but when it fails with a permission error
+// (e.g. the commands made directories read-only), it retries making the
+// directories writable as it descends into them. It returns a *cleanupError
+// listing what couldn't be removed.
+func removeAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, fs.ErrPermission) {
+		debug("permission error while removing", path+", making directories writable and retrying")
+		err = removeWritable(path)
+		if err == nil {
+			return nil
+		}
+	}
+
+	err = removeBusy(path, err)
+	if err == nil {
+		return nil
+	}
+	return &cleanupError{paths: remainingPaths(path), err: err}
+}
+
+// removeWritable removes path, making the directories writable and readable
+// before removing their contents. It removes as much as it can, and returns the
+// first error.
+func removeWritable(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		makeWritable(path, info)
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		var first error
+		for _, entry := range entries {
+			err = removeWritable(filepath.Join(path, entry.Name()))
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return first
+		}
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// makeWritable gives the owner the permission to list and change the
+// directory dir, whose info is given, if it lacks it.
+func makeWritable(dir string, info fs.FileInfo) {
+	if perm := info.Mode().Perm(); perm&0700 != 0700 {
+		err := os.Chmod(dir, perm|0700)
+		if err != nil {
+			debug("cannot make", dir, "writable:", err)
+		}
+	}
+}
+
+// remainingPaths lists the files left under path, and the directories that
+// couldn't be read.
+func remainingPaths(path string) []string {
+	var paths []string
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if len(paths) == 0 {
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const removeRetries = 5
+
+// removeBusy handles paths that couldn't be removed. On Windows, files can't be
+// removed while they're open, and they often are for a little while after the
+// commands exit: by processes they left behind, or by antivirus scanners. So
+// removeBusy retries with a backoff, then moves what's left to the temp dir, so
+// that the path can be reused, and has Windows remove it on reboot.
+func removeBusy(path string, err error) error {
+	delay := 100 * time.Millisecond
+	for i := 0; i < removeRetries; i++ {
+		debug("could not remove", path+", retrying in", delay)
+		clock.Sleep(delay)
+		err = os.RemoveAll(path)
+		if err == nil {
+			return nil
+		}
+		delay *= 2
+	}
+
+	// out of the extraction dir, which must be left clean for the next runs;
+	// the temp dir is usually on the same volume, which renames require
+	trash := filepath.Join(os.TempDir(), fmt.Sprintf("selfextract-trash-%d-%s", clock.Now().UnixNano(), filepath.Base(path)))
+	if rerr := os.Rename(path, trash); rerr == nil {
+		debug("moved", path, "to", trash)
+		path = trash
+		if os.RemoveAll(path) == nil {
+			return nil
+		}
+	} else {
+		debug("cannot move", path, "out of the extraction dir:", rerr)
+	}
+
+	// children must be scheduled before their parents, which are removed
+	// only if empty
+	var paths []string
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		paths = append(paths, p)
+		return nil
+	})
+	for i := len(paths) - 1; i >= 0; i-- {
+		p, perr := windows.UTF16PtrFromString(paths[i])
+		if perr == nil {
+			perr = windows.MoveFileEx(p, nil, windows.MOVEFILE_DELAY_UNTIL_REBOOT)
+		}
+		if perr != nil {
+			debug("cannot schedule removal of", paths[i], "on reboot:", perr)
+			return err
+		}
+	}
+	warn(path, "is still in use, it will be removed on reboot")
+	return nil
+}
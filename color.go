@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+const (
+	colorDim    = "\x1b[2m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[1;31m"
+	colorReset  = "\x1b[0m"
+)
+
+// useColor tells whether messages are colored. They are only when written to
+// a terminal that supports it, and NO_COLOR (https://no-color.org) isn't set.
+var useColor = colorSupported()
+
+func colorSupported() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	term := os.Getenv("TERM")
+	if term == "dumb" || (term == "" && runtime.GOOS == "windows") {
+		// the Windows console only understands escape sequences when
+		// enabled, terminal emulators set TERM
+		return false
+	}
+	return isTerminal(os.Stderr)
+}
+
+// colorize wraps s in the escape sequences of a color, if colors are used.
+func colorize(color, s string) string {
+	if !useColor {
+		return s
+	}
+	return color + s + colorReset
+}
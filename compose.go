@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// composeFileName is the file declaring several commands to run together. Each
+// line declares a command as:
+//
+//	NAME [after=DEP,...]: COMMAND [ARG...]
+//
+// Commands are started in the order of their dependencies, then in the order
+// of the file. They are supervised as a group: as soon as one exits, the
+// others are stopped, and the exit code of the archive is the one of the first
+// command that exited. Empty lines and lines starting with # are ignored.
+const composeFileName = "selfextract_compose"
+
+type composeEntry struct {
+	name  string
+	after []string
+	args  []string
+}
+
+func (se *selfExtractor) parseCompose(path string) ([]composeEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []composeEntry
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		decl, cmdline, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing ':' after command name", lineNo)
+		}
+		fields := strings.Fields(decl)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing command name", lineNo)
+		}
+		e := composeEntry{name: fields[0]}
+		for _, opt := range fields[1:] {
+			if !strings.HasPrefix(opt, "after=") {
+				return nil, fmt.Errorf("line %d: unknown option %q", lineNo, opt)
+			}
+			e.after = append(e.after, strings.Split(strings.TrimPrefix(opt, "after="), ",")...)
+		}
+		e.args, err = se.splitCmdline(cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(e.args) == 0 {
+			return nil, fmt.Errorf("line %d: empty command", lineNo)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return orderCompose(entries)
+}
+
+// orderCompose sorts the entries so that each one comes after its
+// dependencies, keeping the order of the file otherwise.
+func orderCompose(entries []composeEntry) ([]composeEntry, error) {
+	byName := make(map[string]composeEntry)
+	for _, e := range entries {
+		if _, ok := byName[e.name]; ok {
+			return nil, fmt.Errorf("duplicate command name %q", e.name)
+		}
+		byName[e.name] = e
+	}
+
+	var ordered []composeEntry
+	state := make(map[string]int) // 1: visiting, 2: done
+	var visit func(e composeEntry) error
+	visit = func(e composeEntry) error {
+		switch state[e.name] {
+		case 1:
+			return fmt.Errorf("dependency cycle involving %q", e.name)
+		case 2:
+			return nil
+		}
+		state[e.name] = 1
+		for _, dep := range e.after {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("%q depends on unknown command %q", e.name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[e.name] = 2
+		ordered = append(ordered, e)
+		return nil
+	}
+	for _, e := range entries {
+		if err := visit(e); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+type composeExit struct {
+	name string
+	code int
+}
+
+// runCompose runs the commands of a compose file as a group.
+func (se *selfExtractor) runCompose(path string) {
+	entries, err := se.parseCompose(path)
+	if err != nil {
+		debug("failed to parse compose file:", err)
+		se.exitCode <- 1
+		return
+	}
+	if len(entries) == 0 {
+		debug("compose file declares no command")
+		se.exitCode <- 0
+		return
+	}
+
+	done := timePhase("run")
+	exits := make(chan composeExit, len(entries))
+	pending := 0
+	for _, e := range entries {
+		debug("starting", e.name)
+		cmd := exec.Command(e.args[0], e.args[1:]...)
+		err := se.startCommand(cmd)
+		if err != nil {
+			debug(e.name, "failed to start:", err)
+			exits <- composeExit{e.name, 1}
+			pending++
+			break
+		}
+		pending++
+		go func(name string) {
+			exits <- composeExit{name, se.waitCommand(cmd, name)}
+		}(e.name)
+	}
+
+	first := <-exits
+	debug(first.name, "exited with code", first.code, "stopping the other commands")
+	se.stopChildren()
+	for i := 1; i < pending; i++ {
+		e := <-exits
+		debug(e.name, "exited with code", e.code)
+	}
+	done()
+	se.exitCode <- first.code
+}
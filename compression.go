@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The payload is a tar, compressed with one of the codecs below, whose name is
+// recorded in a trailing block. Archives made before it was recorded are
+// recognized from the magic number each built-in format starts with.
+
+// codec is a compression algorithm of payloads. Forks add their own with a
+// file registering them in an init function, without changing how archives
+// are created or extracted; creators also need them to implement
+// compressingCodec, and rewrap -stub to find their name in capabilities.
+type codec interface {
+	// magic returns the bytes the compressed data starts with, to recognize
+	// the archives not recording their codec, or nil for the codecs only
+	// found in the archives recording them
+	magic() []byte
+	newReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{}
+
+// registerCodec makes a codec available under name, which -z accepts and
+// inspect prints. It panics when the name is already taken, or when the magic
+// would be mistaken for the one of another codec.
+func registerCodec(name string, c codec) {
+	if _, ok := codecs[name]; ok {
+		panic("codec registered twice: " + name)
+	}
+	if name == "none" || name == "encrypted" {
+		panic("reserved codec name: " + name)
+	}
+	if m := c.magic(); len(m) > 0 {
+		for other, o := range codecs {
+			om := o.magic()
+			if len(om) > 0 && (bytes.HasPrefix(m, om) || bytes.HasPrefix(om, m)) {
+				panic("codec " + name + " has the magic of " + other)
+			}
+		}
+	}
+	codecs[name] = c
+}
+
+// lookupCodec returns the codec registered under name. Uncompressed payloads
+// have the "none" codec.
+func lookupCodec(name string) (codec, bool) {
+	if name == "none" {
+		return noCodec{}, true
+	}
+	c, ok := codecs[name]
+	return c, ok
+}
+
+func init() {
+	registerCodec("zstd", zstdCodec{})
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) magic() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+func (zstdCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	// accept the largest windows the creator can use
+	zOpts := []zstd.DOption{zstd.WithDecoderMaxWindow(zstd.MaxWindowSize)}
+	if jobs := decompressionJobs(); jobs > 0 {
+		zOpts = append(zOpts, zstd.WithDecoderConcurrency(jobs))
+	}
+	zRdr, err := zstd.NewReader(r, zOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return zRdr.IOReadCloser(), nil
+}
+
+// noCodec reads uncompressed payloads, recognized by the tar magic instead of
+// one of their own.
+type noCodec struct{}
+
+func (noCodec) magic() []byte {
+	return nil
+}
+
+func (noCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+const defaultCompression = "zstd"
+
+// tarMagicOffset is where the magic of the ustar, pax and GNU formats is in a
+// tar header, which identifies uncompressed payloads.
+const tarMagicOffset = 257
+
+func compressionBlock(name string) trailingBlock {
+	return trailingBlock{typ: blockCompression, data: []byte(name)}
+}
+
+// recordedCompression returns the name of the codec recorded in the archive,
+// if any.
+func recordedCompression(blocks []trailingBlock) (string, bool) {
+	for _, b := range blocks {
+		if b.typ == blockCompression && len(b.data) > 0 {
+			return string(b.data), true
+		}
+	}
+	return "", false
+}
+
+// detectCompression returns the compression algorithm of the payload, as
+// recorded in its blocks, and a reader of the whole payload. Encrypted
+// payloads are recognized from their header, and the payloads of archives not
+// recording their codec, or of tarballs, from their magic number.
+func detectCompression(r io.Reader, blocks []trailingBlock) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, 1024)
+	head, err := br.Peek(tarMagicOffset + 5)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	if bytes.HasPrefix(head, encryptionMagic) {
+		return "encrypted", br, nil
+	}
+	if name, ok := recordedCompression(blocks); ok {
+		if _, ok := lookupCodec(name); !ok {
+			return "", nil, fmt.Errorf("unknown compression %q", name)
+		}
+		return name, br, nil
+	}
+	for name, c := range codecs {
+		if len(c.magic()) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(head, c.magic()) {
+			return name, br, nil
+		}
+	}
+	if len(head) > tarMagicOffset && bytes.HasPrefix(head[tarMagicOffset:], []byte("ustar")) {
+		return "none", br, nil
+	}
+	if len(head) > 0 && len(bytes.Trim(head, "\x00")) == 0 {
+		// empty tar, made of zero blocks only
+		return "none", br, nil
+	}
+	return "", nil, fmt.Errorf("unknown compression")
+}
+
+// decompressionJobs returns the number of threads decoding zstd payloads set
+// in the environment, or 0 for all the cores.
+func decompressionJobs() int {
+	s := os.Getenv(EnvJobs)
+	if s == "" {
+		return 0
+	}
+	jobs, err := strconv.Atoi(s)
+	if err != nil || jobs < 1 {
+		warn("ignoring invalid", EnvJobs+":", s)
+		return 0
+	}
+	debug("decompressing on", jobs, "threads")
+	return jobs
+}
+
+// newDecompressor decompresses a payload, with the compression algorithm
+// recorded in blocks, or recognized.
+func newDecompressor(r io.Reader, blocks []trailingBlock) (io.ReadCloser, error) {
+	name, r, err := detectCompression(r, blocks)
+	if err != nil {
+		return nil, err
+	}
+	debug("payload compression:", name)
+	if name == "encrypted" {
+		passphrase, err := readPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		r, err = newDecryptReader(r, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return newDecompressor(r, blocks)
+	}
+	c, _ := lookupCodec(name)
+	return c.newReader(r)
+}
@@ -0,0 +1,117 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// compress compresses data with the codec registered under name.
+func compress(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newCompressor(&buf, createOptions{compression: compressionFlag(name), jobs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// reverseCodec is a codec without magic, which reverses the bytes of the
+// payload.
+type reverseCodec struct{}
+
+func (reverseCodec) magic() []byte {
+	return nil
+}
+
+func (reverseCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestDetectCompression(t *testing.T) {
+	registerCodec("reverse", reverseCodec{})
+	defer delete(codecs, "reverse")
+
+	// an empty tar, recognized without compression
+	tarData := make([]byte, 1024)
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		blocks  []trailingBlock
+		want    string
+		err     string
+	}{
+		{"recorded zstd", compress(t, "zstd", tarData), []trailingBlock{compressionBlock("zstd")}, "zstd", ""},
+		{"recorded none", tarData, []trailingBlock{compressionBlock("none")}, "none", ""},
+		{"recorded without magic", []byte("dcba"), []trailingBlock{compressionBlock("reverse")}, "reverse", ""},
+		{"recorded unknown", tarData, []trailingBlock{compressionBlock("nope")}, "", "unknown compression"},
+		{"sniffed zstd", compress(t, "zstd", tarData), nil, "zstd", ""},
+		{"sniffed gzip", compress(t, "gzip", tarData), nil, "gzip", ""},
+		{"sniffed xz", compress(t, "xz", tarData), nil, "xz", ""},
+		{"sniffed lz4", compress(t, "lz4", tarData), nil, "lz4", ""},
+		{"sniffed none", tarData, nil, "none", ""},
+		{"not sniffed without magic", []byte("dcba"), nil, "", "unknown compression"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name, r, err := detectCompression(bytes.NewReader(tc.payload), tc.blocks)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got compression %q and error %v, want %q", name, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tc.want {
+				t.Errorf("got compression %q, want %q", name, tc.want)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(data, tc.payload) {
+				t.Errorf("payload not read whole: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewDecompressorRecorded(t *testing.T) {
+	registerCodec("reverse", reverseCodec{})
+	defer delete(codecs, "reverse")
+
+	zRdr, err := newDecompressor(strings.NewReader("dcba"), []trailingBlock{compressionBlock("reverse")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zRdr)
+	if err != nil || string(data) != "abcd" {
+		t.Errorf("got %q and error %v", data, err)
+	}
+}
+
+func TestRegisterCodecMagic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("codec with the magic of gzip registered")
+		}
+	}()
+	registerCodec("gzip2", gzipCodec{})
+	delete(codecs, "gzip2")
+}
@@ -0,0 +1,131 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// compressingCodec is a codec that can also compress payloads, which all
+// the codecs can in creators.
+type compressingCodec interface {
+	codec
+	newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error)
+}
+
+// compressionNames lists the algorithms -z accepts.
+func compressionNames() []string {
+	names := []string{"none"}
+	for name, c := range codecs {
+		if _, ok := c.(compressingCodec); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressionFlag is the name of a compression algorithm, as a flag.
+type compressionFlag string
+
+func (c *compressionFlag) String() string {
+	return string(*c)
+}
+
+func (c *compressionFlag) Set(s string) error {
+	algo, ok := lookupCodec(s)
+	if _, compresses := algo.(compressingCodec); !ok || !compresses {
+		return fmt.Errorf("unknown compression %q, expected one of: %s", s, strings.Join(compressionNames(), ", "))
+	}
+	*c = compressionFlag(s)
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressionName returns the name of the codec of the compression options.
+func compressionName(opts createOptions) string {
+	if opts.compression == "" {
+		return defaultCompression
+	}
+	return string(opts.compression)
+}
+
+// newCompressor compresses what is written to it into w, with the codec of
+// the compression options.
+func newCompressor(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	name := compressionName(opts)
+	c, _ := lookupCodec(name)
+	cc, ok := c.(compressingCodec)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return cc.newWriter(w, opts)
+}
+
+// newWriter tunes zstd with the compression options.
+func (zstdCodec) newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	level := zstd.SpeedFastest
+	if opts.level != 0 {
+		// the levels of the zstd command are mapped to the few ones of
+		// the encoder
+		level = zstd.EncoderLevelFromZstd(opts.level)
+		debug("using compression level", opts.level, "("+level.String()+")")
+	}
+	jobs := opts.jobs
+	if jobs == 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	// even empty payloads are a frame, to be recognized as zstd
+	zOpts := []zstd.EOption{zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(jobs), zstd.WithZeroFrames(true)}
+	chunkSize := minZstdChunkSize
+	if opts.long != 0 {
+		debug("using compression window of", 1<<opts.long, "bytes")
+		zOpts = append(zOpts, zstd.WithWindowSize(1<<opts.long))
+		if 1<<opts.long > chunkSize {
+			chunkSize = 1 << opts.long
+		}
+	}
+	// the frames don't depend on the number of cores, so that archives are
+	// the same on every machine
+	if opts.jobs == 1 {
+		return zstd.NewWriter(w, zOpts...)
+	}
+	debug("compressing on", jobs, "threads")
+	enc, err := zstd.NewWriter(nil, zOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return newParallelZstdWriter(w, enc, jobs, chunkSize), nil
+}
+
+func (gzipCodec) newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (xzCodec) newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+func (lz4Codec) newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+func (noCodec) newWriter(w io.Writer, opts createOptions) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// setting is a resolved configuration value, with where it comes from.
+type setting struct {
+	name   string
+	value  string
+	source string
+}
+
+// envSetting resolves a setting from the environment, or its default value.
+func envSetting(name, env, def string) setting {
+	if v := os.Getenv(env); v != "" {
+		return setting{name, v, env}
+	}
+	return setting{name, def, "default"}
+}
+
+// effectiveConfig lists the settings used when running the archive.
+func effectiveConfig(compression string, settings archiveSettings) []setting {
+	dir := envSetting("extraction dir", EnvDir, "(temporary directory)")
+	cleanup := setting{"cleanup", "remove extraction dir after run", "temporary extraction dir"}
+	if dir.source != "default" {
+		cleanup = setting{"cleanup", "keep extraction dir", "persistent extraction dir"}
+	}
+
+	// invalid values are ignored, so show the parsed value
+	grace := envSetting("grace timeout", EnvGraceTimeout, "")
+	grace.value = graceTimeout().String()
+
+	prefix := setting{"env prefix", envPrefix, "default"}
+	if settings.EnvPrefix != "" {
+		prefix.source = "archive"
+	}
+
+	return []setting{
+		prefix,
+		dir,
+		{"allowed dirs", allowedDirsValue(settings), "archive"},
+		{"expires", expiresValue(settings), "archive"},
+		{"revocation list", revocationValue(settings), "archive"},
+		cleanup,
+		envSetting("merge", EnvMerge, "false"),
+		envSetting("on conflict", EnvOnConflict, "prompt on a terminal, abort otherwise"),
+		envSetting("extract only", EnvExtractOnly, "false"),
+		envSetting("cmdline file", EnvCmdline, "selfextract_cmdline"),
+		cmdSetting(settings),
+		entrySetting(settings),
+		envSetting("startup script", EnvStartup, "selfextract_startup"),
+		execSetting(settings),
+		serverSetting(settings),
+		envSetting("server idle", EnvServerIdle, "600"),
+		grace,
+		{"compression", compression, "archive"},
+		{"env", envValue(settings), "archive"},
+		{"scrub env", scrubEnvValue(settings), "archive"},
+		countRunsSetting(settings),
+		envSetting("allow trailing data", EnvAllowTrailing, "false"),
+		envSetting("allow unsafe paths", EnvAllowUnsafePaths, "false"),
+		envSetting("audit file", EnvAuditFile, "(none)"),
+		envSetting("status file", EnvStatusFile, "(none)"),
+		envSetting("keep dir in /tmp", EnvKeepTmp, "false"),
+		envSetting("owner map", EnvOwnerMap, "(none)"),
+		envSetting("group map", EnvGroupMap, "(none)"),
+		preserveOwnerSetting(settings),
+		envSetting("preserve special bits", EnvPreserveSpecialBits, "false"),
+		envSetting("no mtime", EnvNoMtime, "false"),
+		envSetting("create dirs first", EnvPrecreateDirs, "false"),
+		envSetting("log dir", EnvLogDir, "(none)"),
+		envSetting("log max size", EnvLogMaxSize, "10M"),
+		envSetting("log tee", EnvLogTee, "false"),
+		envSetting("scan block size", EnvScanBlockSize, "128K, 1M on network filesystems"),
+		envSetting("read block size", EnvReadBlockSize, "as asked, 1M on network filesystems"),
+		envSetting("readahead", EnvReadahead, "true"),
+		envSetting("zstd threads", EnvJobs, "all cores"),
+		envSetting("verbose", EnvVerbose, "false"),
+	}
+}
+
+func cmdSetting(settings archiveSettings) setting {
+	if os.Getenv(EnvCmd) != "" {
+		return envSetting("command", EnvCmd, "")
+	}
+	if settings.Cmd == "" {
+		return setting{"command", "(none)", "default"}
+	}
+	return setting{"command", settings.Cmd, "archive"}
+}
+
+func entrySetting(settings archiveSettings) setting {
+	if os.Getenv(EnvEntry) != "" {
+		return envSetting("entrypoint", EnvEntry, "")
+	}
+	if len(settings.Entries) == 0 {
+		return setting{"entrypoints", "(none)", "default"}
+	}
+	return setting{"entrypoints", strings.Join(entryNames(settings), ", "), "archive"}
+}
+
+func execSetting(settings archiveSettings) setting {
+	if settings.Exec {
+		return setting{"exec", "true", "archive"}
+	}
+	return envSetting("exec", EnvExec, "false")
+}
+
+func serverSetting(settings archiveSettings) setting {
+	if settings.Server && os.Getenv(EnvServer) == "" {
+		return setting{"server", "true", "archive"}
+	}
+	return envSetting("server", EnvServer, "false")
+}
+
+func preserveOwnerSetting(settings archiveSettings) setting {
+	if settings.PreserveOwner {
+		return setting{"preserve owner", "true", "archive"}
+	}
+	return envSetting("preserve owner", EnvPreserveOwner, "false")
+}
+
+func countRunsSetting(settings archiveSettings) setting {
+	if settings.CountRuns == "" {
+		return setting{"count runs", "false", "default"}
+	}
+	path, err := usagePath(settings.CountRuns)
+	if err != nil {
+		return setting{"count runs", settings.CountRuns + " (" + err.Error() + ")", "archive"}
+	}
+	return setting{"count runs", path, "archive"}
+}
+
+func envValue(settings archiveSettings) string {
+	if len(settings.Env) == 0 {
+		return "(none)"
+	}
+	var names []string
+	for _, kv := range settings.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func expiresValue(settings archiveSettings) string {
+	if settings.Expires == nil {
+		return "never"
+	}
+	return settings.Expires.Format(time.RFC3339)
+}
+
+func revocationValue(settings archiveSettings) string {
+	if settings.RevocationURL == "" {
+		return "(none)"
+	}
+	value := settings.RevocationURL
+	if settings.RevocationRequired {
+		value += ", required"
+	}
+	if settings.RevocationMaxAge > 0 {
+		value += ", at most " + settings.RevocationMaxAge.String() + " old"
+	}
+	if settings.RevocationInterval > 0 {
+		value += ", checked every " + settings.RevocationInterval.String()
+	}
+	return value
+}
+
+func scrubEnvValue(settings archiveSettings) string {
+	if !settings.ScrubEnv {
+		return "false"
+	}
+	if len(settings.KeepEnv) == 0 {
+		return "true"
+	}
+	return "true, keeping " + strings.Join(settings.KeepEnv, ", ")
+}
+
+func printConfig(compression string, settings archiveSettings) {
+	for _, s := range effectiveConfig(compression, settings) {
+		fmt.Printf("%-20s %s (%s)\n", s.name+":", s.value, s.source)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// copyRaw copies the size bytes of data at the current position of the raw
+// payload to f. Copying from a file to a file is done by the system where
+// supported, e.g. with copy_file_range on Linux, without going through the
+// memory of the stub. The data of the files isn't aligned on blocks in the
+// payload, so the copies don't share their blocks with the archive on
+// copy-on-write filesystems.
+func (se *selfExtractor) copyRaw(f *os.File, size int64) error {
+	pos, err := se.rawPayload.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// the section reader doesn't use the offset of the file, which is free
+	_, err = se.rawPayload.file.Seek(se.rawPayload.off+pos, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(se.rawPayload.file, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d bytes out of %d: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	return err
+}
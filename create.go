@@ -1,27 +1,220 @@
+//go:build !stubonly
+
 package main
 
 import (
 	"archive/tar"
+	"crypto/sha256"
   "encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
-
-	"github.com/klauspost/compress/zstd"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func create(self io.Reader, key []byte, out string, files []string, cd string) {
-	if len(files) == 0 {
+// createOptions holds the settings of create mode.
+type createOptions struct {
+	out     string      // path of the archive
+	files   []inputFile // files to archive
+	dir     string      // directory the first files are relative to
+	maxSize byteSize    // fail if the archive is bigger, if not zero
+	walk    walkOptions
+	exclude []string // glob patterns of the files not to archive
+	// skip the files that can't be read for lack of permission
+	ignoreUnreadable bool
+
+	// importing an existing tar
+	fromTar         string // path of the tar, or "-" for stdin
+	stripComponents int
+	noSameOwner     bool
+	tarInclude      []string
+	tarExclude      []string
+	tarInput        io.Reader // tar to import instead of fromTar
+	noHardLinks     bool      // fail on hard links, which the stub can't extract
+	// paths of the tar not imported, as the files to archive replace them
+	replaced map[string]bool
+
+	// trailing blocks to keep instead of those of an existing archive at out,
+	// if not nil
+	blocks []trailingBlock
+
+	filters filterList // transforms applied to file contents
+	long    windowLog  // custom compression window, if not zero
+
+	compression compressionFlag // algorithm, zstd if empty
+	level       int             // zstd compression level, fastest if zero
+	jobs        int             // zstd compression threads, all cores if zero
+
+	passphrase []byte // encrypt the payload with it, if not nil
+	keyVersion int    // of the key of the archive, see archiveKey
+	xattrs     bool   // record the extended attributes of the files
+	// encrypt the contents of the files matching encryptFiles with
+	// filesPassphrase, within a payload that may not be
+	encryptFiles    []string
+	filesPassphrase []byte
+	// append a record of the archive to this file, if not empty
+	escrow string
+	// archive the selfextract archives among the files, which is mostly
+	// done by accident
+	allowNested bool
+	// write the same archive from the same inputs, clamping times to
+	// sourceDate, if not nil
+	reproducible bool
+	sourceDate   *time.Time
+	// derive the key from the contents, so that rebuilds of the same
+	// contents reuse the extraction dirs
+	contentKey bool
+	packStub   string // command packing the stub, e.g. upx, if not empty
+
+	// remapping of the owners of the files
+	ownerMap idMap
+	groupMap idMap
+
+	messages string // path of the translations of the messages of the stub
+	helpText string // path of the help text of the archive
+
+	settings archiveSettings
+	metadata archiveMetadata
+}
+
+// inputFile is a file to archive, relative to the directory set by the -C
+// preceding it.
+type inputFile struct {
+	dir  string
+	path string
+}
+
+// parseInputFiles reads the files to archive from the arguments left after the
+// flags. Like with tar, -C DIR can be repeated among them to change the
+// directory the following files are relative to, relatively to the previous
+// one. Files must be inside their directory, so that their paths in the
+// archive are too.
+func parseInputFiles(dir string, args []string) []inputFile {
+	var files []inputFile
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-C", arg == "--C":
+			i++
+			if i == len(args) {
+				die("missing directory after", arg)
+			}
+			dir = changeDir(dir, args[i])
+		case strings.HasPrefix(arg, "-C="), strings.HasPrefix(arg, "--C="):
+			dir = changeDir(dir, arg[strings.IndexByte(arg, '=')+1:])
+		default:
+			files = append(files, newInputFile(dir, arg))
+		}
+	}
+	return files
+}
+
+// newInputFile returns the file to archive named arg, relative to dir.
+func newInputFile(dir, arg string) inputFile {
+	name := filepath.Clean(arg)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		die("input file", arg, "is outside of", dir+", use -C to archive it relatively to another directory")
+	}
+	return inputFile{dir, name}
+}
+
+func changeDir(dir, to string) string {
+	if filepath.IsAbs(to) {
+		return to
+	}
+	return filepath.Join(dir, to)
+}
+
+// fileSize records the size of an archived file.
+type fileSize struct {
+	path string
+	size int64
+}
+
+func create(self io.Reader, key []byte, opts createOptions) {
+	out, files := opts.out, opts.files
+	if len(files) == 0 && opts.fromTar == "" && opts.tarInput == nil {
 		die("no files to archive")
 	}
 
-	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	// concurrent runs writing the same archive are serialized
+	lock, err := lockPath(out)
+	if err != nil {
+		die("locking output file:", err)
+	}
+	defer lock.unlock()
+	dieHooks = append(dieHooks, lock.unlock)
+
+	// when overwriting an existing archive, keep the blocks other tools
+	// appended to it
+	blocks := opts.blocks
+	if blocks == nil {
+		oldBlocks, err := archiveTrailingBlocks(out)
+		for _, b := range oldBlocks {
+			if !ownBlock(b) {
+				blocks = append(blocks, b)
+			}
+		}
+		if err == nil && len(blocks) > 0 {
+			debug("keeping", len(blocks), "trailing blocks of", out)
+		}
+	}
+	blocks = append(blocks, buildInfoBlock())
+	if opts.messages != "" {
+		b, err := readMessages(opts.messages)
+		if err != nil {
+			die("reading translated messages:", err)
+		}
+		blocks = append(blocks, b)
+	}
+	if opts.helpText != "" {
+		b, err := helpBlock(opts.helpText)
+		if err != nil {
+			die("reading help text:", err)
+		}
+		blocks = append(blocks, b)
+	}
+	if b, ok := opts.settings.block(); ok {
+		blocks = append(blocks, b)
+	}
+	if b, ok := opts.metadata.block(opts.reproducible, opts.sourceDate); ok {
+		blocks = append(blocks, b)
+	}
+
+	// the archive is written to a temporary file renamed once complete, so
+	// that a failure never leaves a truncated archive behind
+	f, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".tmp")
 	if err != nil {
 		die("opening output file:", err)
 	}
+	tmpOut := f.Name()
+	dieHooks = append(dieHooks, func() {
+		f.Close()
+		os.Remove(tmpOut)
+	})
 
-	_, err = io.Copy(f, self)
+	stub, err := io.ReadAll(self)
+	if err != nil {
+		die("reading stub:", err)
+	}
+	if opts.packStub != "" {
+		// the size of the packed stub isn't known when stamping, the
+		// boundary is found from the trailing blocks instead
+		stub, err = packStub(stub, opts.packStub)
+		if err != nil {
+			die("packing stub:", err)
+		}
+	} else if !stampStub(stub) {
+		debug("cannot stamp boundary offset in stub, it will find it from the trailing blocks")
+	}
+	_, err = f.Write(stub)
 	if err != nil {
 		die("writing stub to output file:", err)
 	}
@@ -31,7 +224,17 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 		die("writing boundary to output file:", err)
 	}
 
-	_, err = f.Write(generateRandomKey())
+	// content keys are derived from the payload, once written
+	deriveKey := key == nil && opts.contentKey
+	if deriveKey {
+		key = make([]byte, keyLength)
+	} else if key == nil {
+		key = generateRandomKey()
+		if b, ok := generateKeyBlock(opts.keyVersion); ok {
+			blocks = append(blocks, b)
+		}
+	}
+	_, err = f.Write(key)
 	if err != nil {
 		die("writing key to output file:", err)
 	}
@@ -46,19 +249,53 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
     die("getting start position of payload:", err)
   }
 
-	zWrt, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	digest := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, digest)}
+	var compressed io.Writer = counter
+	var encWrt io.WriteCloser
+	if opts.passphrase != nil {
+		encWrt, err = newEncryptWriter(counter, opts.passphrase)
+		if err != nil {
+			die("creating encrypter:", err)
+		}
+		compressed = encWrt
+	}
+	zWrt, err := newCompressor(compressed, opts)
 	if err != nil {
-		die("creating zstd compressor:", err)
+		die("creating compressor:", err)
 	}
 
-	tarWrt := tar.NewWriter(zWrt)
+	// the digest of the tar doesn't depend on how it is compressed
+	contentDigest := sha256.New()
+	uncompressed := &countingWriter{w: zWrt}
+	if deriveKey {
+		uncompressed.w = io.MultiWriter(zWrt, contentDigest)
+	}
+	tarWrt := tar.NewWriter(uncompressed)
+	var sizes []fileSize
+	var encryptedFiles []string
+	// first archived path of the files with several hard links
+	linked := make(map[fileID]string)
+	estimator := &sizeEstimator{opts: opts}
+	// a single thread keeps the frames of the estimates alike
+	estimator.opts.jobs = 1
 
-	for _, file := range files {
-		rootDir := os.DirFS(cd)
-		file = filepath.Clean(file)
-		// file may be a simple file or a directory, walkdir works for both
-		fs.WalkDir(rootDir, file, func(path string, d fs.DirEntry, err error) error {
+	for _, input := range files {
+		cd, file := input.dir, filepath.ToSlash(input.path)
+		// file may be a simple file or a directory, walkInput works for both
+		err := walkInput(cd, file, opts.walk, func(path string, d fs.DirEntry, err error) error {
+			if path != "." && matchAny(path, opts.exclude) {
+				debug("excluding", path)
+				if d != nil && d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
 			if err != nil {
+				if opts.ignoreUnreadable && errors.Is(err, fs.ErrPermission) {
+					warn("skipping unreadable file:", path)
+					return nil
+				}
 				die("opening input file", path, err)
 			}
 			if path == "." {
@@ -74,7 +311,34 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 				die("getting info about file:", path)
 			}
 			mode := info.Mode()
-			hdr.Mode = int64(mode)
+			hdr.Mode = tarMode(mode)
+			hdr.ModTime = info.ModTime()
+			if uid, gid, ok := fileOwner(info); ok {
+				hdr.Uid, _ = opts.ownerMap.lookup(uid)
+				hdr.Gid, _ = opts.groupMap.lookup(gid)
+			}
+			if opts.xattrs {
+				xattrs, err := listXattrs(filepath.Join(cd, path))
+				if err != nil {
+					die("reading extended attributes of", path+":", err)
+				}
+				for name, value := range xattrs {
+					if skippedXattrs[name] {
+						continue
+					}
+					if hdr.PAXRecords == nil {
+						hdr.PAXRecords = make(map[string]string)
+					}
+					hdr.PAXRecords[xattrRecordPrefix+name] = value
+				}
+			}
+			if opts.reproducible {
+				normalizeHeader(&hdr, opts.sourceDate)
+			}
+
+			// path of the contents to archive, which differs when filtered
+			srcPath := filepath.Join(cd, path)
+			src := srcPath
 
 			switch mode.Type() {
 			case fs.ModeDir:
@@ -87,19 +351,98 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 				}
 				hdr.Linkname = target
 			case 0: // regular file
+				// check it can be read before anything is archived
+				rf, err := os.Open(srcPath)
+				if err != nil {
+					if opts.ignoreUnreadable && errors.Is(err, fs.ErrPermission) {
+						warn("skipping unreadable file:", path)
+						return nil
+					}
+					die("opening file:", path)
+				}
+				rf.Close()
+				if !opts.allowNested && isArchive(srcPath) {
+					die("input file", path, "is a selfextract archive, use -allow-nested to archive it anyway")
+				}
+				id, isLink := hardLinkID(info)
+				if first, ok := linked[id]; isLink && ok {
+					debug("archiving", path, "as a hard link to", first)
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					break
+				}
+				if isLink {
+					linked[id] = path
+				}
 				hdr.Typeflag = tar.TypeReg
 				hdr.Size = info.Size()
+				if filters := opts.filters.matching(path); len(filters) > 0 {
+					src, err = applyFilters(srcPath, filters)
+					if err != nil {
+						die("filtering file:", path, err)
+					}
+					defer os.Remove(src)
+					filtered, err := os.Stat(src)
+					if err != nil {
+						die("getting info about filtered file:", path, err)
+					}
+					hdr.Size = filtered.Size()
+				}
+				if matchAny(path, opts.encryptFiles) {
+					debug("encrypting", path)
+					encrypted, err := encryptFile(src, opts.filesPassphrase)
+					if err != nil {
+						die("encrypting file:", path, err)
+					}
+					defer os.Remove(encrypted)
+					info, err := os.Stat(encrypted)
+					if err != nil {
+						die("getting info about encrypted file:", path, err)
+					}
+					if hdr.PAXRecords == nil {
+						hdr.PAXRecords = make(map[string]string)
+					}
+					hdr.PAXRecords[encryptedRecord] = strconv.FormatInt(hdr.Size, 10)
+					src, hdr.Size = encrypted, info.Size()
+					encryptedFiles = append(encryptedFiles, path)
+				}
+				sizes = append(sizes, fileSize{path, hdr.Size})
 			default:
 				die("unsupported file type:", path)
 			}
 
+			// filtered and encrypted files are written whole
+			if hdr.Typeflag == tar.TypeReg && src == srcPath {
+				if regions, ok := dataRegions(src, info); ok {
+					debug("archiving", path, "as a sparse file with", len(regions), "data regions")
+					err = writeSparseEntry(tarWrt, uncompressed, &hdr, src, regions)
+					if err != nil {
+						die("writing sparse file to tar:", path, err)
+					}
+					return nil
+				}
+			}
+
+			// the files of uncompressed payloads are copied without being
+			// read, their digest can't be computed when extracting
+			if hdr.Typeflag == tar.TypeReg && opts.compression == "none" {
+				sum, err := fileDigest(src)
+				if err != nil {
+					die("computing digest of file:", path, err)
+				}
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[digestRecord] = sum
+			}
+
 			err = tarWrt.WriteHeader(&hdr)
 			if err != nil {
 				die("writing tar header of file:", path)
 			}
 
-			if mode.Type() == 0 {
-				wf, err := os.Open(filepath.Join(cd, path))
+			if hdr.Typeflag == tar.TypeReg {
+				wf, err := os.Open(src)
 				if err != nil {
 					die("opening file:", path)
 				}
@@ -108,10 +451,25 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 					die("writing file to tar:", path)
 				}
 				wf.Close()
+
+				if veryVerbose {
+					compressed, err := estimator.size(src)
+					if err != nil {
+						die("estimating compressed size of file:", path, err)
+					}
+					debug(fmt.Sprintf("compressed %s: %d -> %d bytes (%.1f%%)", path, hdr.Size, compressed, 100*float64(compressed)/float64(max64(hdr.Size, 1))))
+				}
 			}
 
 			return nil
 		})
+		if err != nil {
+			die("walking input files:", err)
+		}
+	}
+
+	if opts.fromTar != "" || opts.tarInput != nil {
+		sizes = append(sizes, importTar(tarWrt, uncompressed, opts)...)
 	}
 
 	err = tarWrt.Close()
@@ -120,8 +478,28 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 	}
 	err = zWrt.Close()
 	if err != nil {
-		die("closing zstd:", err)
+		die("closing compressor:", err)
+	}
+	if encWrt != nil {
+		err = encWrt.Close()
+		if err != nil {
+			die("closing encrypter:", err)
+		}
+	}
+	payloadDigest := digest.Sum(nil)
+	if deriveKey {
+		var b trailingBlock
+		var ok bool
+		key, b, ok = deriveKeys(contentDigest.Sum(nil), opts.keyVersion)
+		if ok {
+			blocks = append(blocks, b)
+		}
+		_, err = f.WriteAt(key, offset-8-int64(len(key)))
+		if err != nil {
+			die("writing key to output file:", err)
+		}
 	}
+	blocks = append(blocks, digestBlock(payloadDigest), payloadSizeBlock(uncompressed.n), compressionBlock(compressionName(opts)), boundaryBlock(int64(len(stub))))
 
   payload_end, err := f.Seek(0, io.SeekCurrent)
   if err != nil {
@@ -137,6 +515,26 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
   binary.LittleEndian.PutUint64(buffer, uint64(payload_end-offset))
   f.Write(buffer)
 
+	_, err = f.Seek(payload_end, io.SeekStart)
+	if err != nil {
+		die("seeking to end of payload:", err)
+	}
+	err = writeTrailingBlocks(f, blocks)
+	if err != nil {
+		die("writing trailing blocks:", err)
+	}
+
+	if opts.maxSize > 0 {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			die("getting size of output file:", err)
+		}
+		if size > int64(opts.maxSize) {
+			printSizeBreakdown(size, offset, sizes)
+			die(fmt.Sprintf("archive is %d bytes, over the maximum size of %d bytes", size, opts.maxSize))
+		}
+	}
+
 	err = f.Chmod(0755)
 	if err != nil {
 		die("making output file executable:", err)
@@ -145,4 +543,126 @@ func create(self io.Reader, key []byte, out string, files []string, cd string) {
 	if err != nil {
 		die("closing output file:", err)
 	}
+	err = os.Rename(tmpOut, out)
+	if err != nil {
+		die("renaming output file:", err)
+	}
+	if opts.escrow != "" {
+		rec := newEscrowRecord(out, key, blocks, opts)
+		rec.PayloadSize = payload_end - offset
+		rec.EncryptedFiles = encryptedFiles
+		err = appendEscrow(opts.escrow, rec)
+		if err != nil {
+			die("writing escrow file:", err)
+		}
+	}
+	reportWarnings()
+}
+
+// isArchive reports whether the file name is a selfextract archive. Only the
+// archives with trailing blocks are recognized, which saves searching the
+// boundary in every file.
+func isArchive(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	off, ok := trailerBoundary(f)
+	return ok && checkBoundary(f, off)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fileDigest returns the hex SHA-256 digest of the file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sizeEstimator compresses files on their own to tell their compressed size,
+// as flushing the compressor of the archive after each file would change the
+// archive.
+type sizeEstimator struct {
+	opts createOptions
+	w    io.WriteCloser
+	n    countingWriter
+}
+
+// size returns the size of the file once compressed.
+func (e *sizeEstimator) size(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	e.n = countingWriter{w: io.Discard}
+	if r, ok := e.w.(interface{ Reset(io.Writer) }); ok {
+		r.Reset(&e.n)
+	} else {
+		e.w, err = newCompressor(&e.n, e.opts)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = io.Copy(e.w, f)
+	if err != nil {
+		return 0, err
+	}
+	err = e.w.Close()
+	if err != nil {
+		return 0, err
+	}
+	return e.n.n, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// maxBreakdownFiles is the number of files listed by printSizeBreakdown.
+const maxBreakdownFiles = 20
+
+// printSizeBreakdown shows what the archive is made of, biggest files first.
+func printSizeBreakdown(size, payloadOff int64, sizes []fileSize) {
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].size > sizes[j].size })
+	var total int64
+	for _, entry := range sizes {
+		total += entry.size
+	}
+
+	w := os.Stderr
+	fmt.Fprintf(w, "%12d  archive\n", size)
+	fmt.Fprintf(w, "%12d  stub and header\n", payloadOff)
+	fmt.Fprintf(w, "%12d  compressed payload\n", size-payloadOff)
+	fmt.Fprintf(w, "%12d  uncompressed files, biggest:\n", total)
+	for i, entry := range sizes {
+		if i == maxBreakdownFiles {
+			fmt.Fprintf(w, "%12s  (%d more files)\n", "...", len(sizes)-i)
+			break
+		}
+		fmt.Fprintf(w, "%12d  %5.1f%%  %s\n", entry.size, 100*float64(entry.size)/float64(total), entry.path)
+	}
 }
@@ -0,0 +1,422 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/klauspost/compress/zstd"
+)
+
+// runCreator runs the creator, which is selfextract when it isn't an archive.
+func runCreator(self io.ReadSeeker) {
+	// without a subcommand, the arguments are those of create, as they were
+	// before there were subcommands
+	cmd, args := "create", os.Args[1:]
+	if len(args) > 0 && isSubcommand(args[0]) {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "rewrap":
+		rewrap(self, args)
+	case "inspect":
+		inspect(args)
+	case "verify":
+		verify(args)
+	default:
+		createCommand(self, args)
+	}
+}
+
+// subcommands of the creator, which an archive doesn't have.
+var subcommands = []string{"create", "rewrap", "inspect", "verify"}
+
+func isSubcommand(arg string) bool {
+	for _, cmd := range subcommands {
+		if arg == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// createCommand parses the arguments of create.
+func createCommand(self io.ReadSeeker, args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s [create] [OPTION...] FILE ...\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "%s rewrap [OPTION...] ARCHIVE\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "%s inspect [OPTION...] ARCHIVE\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "%s verify [OPTION...] ARCHIVE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var opts createOptions
+	flags.StringVar(&opts.out, "f", "selfextract.out", "name of the archive to create")
+	flags.StringVar(&opts.dir, "C", ".", "change dir before archiving files, only affects input files; can be repeated among the files to change dir for the following ones")
+	flags.BoolVar(&opts.walk.dereference, "dereference", false, "archive the files symlinks point to instead of the symlinks")
+	flags.IntVar(&opts.walk.maxDepth, "max-depth", 0, "fail if input directories are nested deeper than `N` levels")
+	flags.Var((*stringList)(&opts.exclude), "exclude", "skip the files matching `GLOB`, and the contents of matching directories (repeatable)")
+	var fileLists stringList
+	flags.Var(&fileLists, "T", "archive the files listed in `FILE` (- for stdin), relative to the first -C, one per line or separated by NUL bytes (repeatable)")
+	var excludeFrom stringList
+	flags.Var(&excludeFrom, "exclude-from", "skip the files matching the GLOB patterns of `FILE`, one per line (repeatable)")
+	flags.BoolVar(&opts.xattrs, "preserve-xattrs", false, "record the extended attributes of the files, including file capabilities and POSIX ACLs, which are restored when extracting")
+	flags.BoolVar(&opts.allowNested, "allow-nested", false, "archive the selfextract archives among the files, instead of failing")
+	flags.BoolVar(&opts.ignoreUnreadable, "ignore-unreadable", false, "skip the files that can't be read for lack of permission instead of failing")
+	flags.Var(&opts.ownerMap, "owner-map", "record the owners of the files as mapped by `FROM:TO` or FIRST-LAST:TO rules, e.g. 100000-165535:0 (repeatable)")
+	flags.Var(&opts.groupMap, "group-map", "record the groups of the files as mapped by `FROM:TO` or FIRST-LAST:TO rules (repeatable)")
+	flags.Var(&opts.maxSize, "max-size", "fail if the archive is bigger than `SIZE` (e.g. 500M)")
+	flags.StringVar(&opts.fromTar, "from-tar", "", "add the entries of an existing tar `FILE` (- for stdin), which may be compressed with gzip, bzip2, xz, zstd or lz4")
+	flags.IntVar(&opts.stripComponents, "strip-components", 0, "strip `N` leading path elements from the entries of the imported tar")
+	flags.BoolVar(&opts.noSameOwner, "no-same-owner", false, "drop the owners of the entries of the imported tar")
+	flags.Var((*stringList)(&opts.tarInclude), "tar-include", "only import the tar entries matching `GLOB` (repeatable)")
+	flags.Var((*stringList)(&opts.tarExclude), "tar-exclude", "skip the tar entries matching `GLOB` (repeatable)")
+	flags.Var(&opts.filters, "filter", "apply `GLOB=FILTER` to the contents of the matching files: strip, crlf or cmd:COMMAND (repeatable)")
+	flags.StringVar(&opts.helpText, "help-text", "", "show the text of `FILE` to the users of the archive running it with "+stubArgPrefix+"help")
+	flags.StringVar(&opts.settings.Cmd, "cmd", "", "run `CMDLINE` after extraction, in which __EXTRACT_DIR__ is replaced by the extraction dir, unless the payload has a cmdline file")
+	var entries stringList
+	flags.Var(&entries, "entry", "add the entrypoint `NAME=CMDLINE`, run instead of the command when the archive is run with "+EnvEntry+"=NAME or as NAME, e.g. through a symlink (repeatable)")
+	flags.StringVar(&opts.settings.EnvPrefix, "env-prefix", "", "configure the archive with environment variables starting with `PREFIX`, e.g. MYAPP_SFX_ for MYAPP_SFX_DIR, instead of "+envPrefix)
+	flags.Var((*stringList)(&opts.settings.Env), "env", "set `NAME=VALUE` in the environment of the commands the archive runs, in which __EXTRACT_DIR__ is replaced by the extraction dir, before the variables of the payload's selfextract_env file (repeatable)")
+	flags.BoolVar(&opts.settings.Exec, "exec", false, "replace the stub by the command it runs instead of running it as a child, when the extraction dir is persistent")
+	flags.BoolVar(&opts.settings.Server, "server", false, "run the command through a server started by the first run, which extracts the payload once, and to which the next runs hand their arguments and standard streams, until idle for "+EnvServerIdle+" seconds (default 600)")
+	flags.Var((*stringList)(&opts.settings.AllowedDirs), "allow-dir", "only extract to a "+EnvDir+" inside the absolute `DIR` (repeatable)")
+	flags.BoolVar(&opts.settings.NoDirOverride, "no-dir-override", false, "refuse "+EnvDir+", to only extract to temporary dirs")
+	expiresFlg := flags.String("expires", "", "refuse to run the archive after `DATE`, as YYYY-MM-DD for the end of that day in UTC or as an RFC 3339 time")
+	flags.StringVar(&opts.settings.RevocationURL, "revocation-url", "", "refuse to run the archive when its key is in the revocation list at `URL`, downloaded with curl")
+	revocationKeyFlg := flags.String("revocation-key", "", "verify the revocation list with the ed25519 public key of the PEM `FILE`")
+	flags.BoolVar(&opts.settings.RevocationRequired, "revocation-required", false, "refuse to run the archive when the revocation list can't be checked, including where curl isn't installed")
+	revocationMaxAgeFlg := flags.Duration("revocation-max-age", 7*24*time.Hour, "refuse revocation lists dated more than `DURATION` ago, or none if 0")
+	revocationIntervalFlg := flags.Duration("revocation-interval", time.Hour, "check the revocation list again after `DURATION`, or at each run if 0")
+	flags.BoolVar(&opts.settings.PreserveOwner, "preserve-owner", false, "give the extracted files their recorded owners and groups when the archive runs as root, as "+EnvPreserveOwner+" does")
+	flags.StringVar(&opts.settings.CountRuns, "count-runs", "", "count the runs of the archive under `NAME` in the state dir of the user, given to the commands as "+EnvRunCount+" with the time of the previous run as "+EnvLastRun)
+	flags.BoolVar(&opts.settings.ScrubEnv, "scrub-env", false, "remove the "+envPrefix+"* variables from the environment of the commands the archive runs, except "+EnvDir+", "+EnvFirstRun+", "+EnvRunCount+", "+EnvLastRun+", "+EnvExitCode+" and the -keep-env ones")
+	flags.Var((*stringList)(&opts.settings.KeepEnv), "keep-env", "keep the variable `NAME` in the environment of the commands with -scrub-env (repeatable)")
+	flags.StringVar(&opts.metadata.Name, "name", "", "record the product `NAME` in the metadata of the archive, printed with "+stubArgPrefix+"metadata")
+	flags.StringVar(&opts.metadata.Version, "product-version", "", "record the product `VERSION` in the metadata of the archive")
+	flags.Var((*keyValues)(&opts.metadata.Meta), "meta", "record `KEY=VALUE` in the metadata of the archive (repeatable)")
+	flags.StringVar(&opts.messages, "messages", "", "show the translated messages of the JSON `FILE` to the users of the archive")
+	flags.Var(&opts.compression, "z", "compress with `ALGO`: "+strings.Join(compressionNames(), ", ")+" (default zstd)")
+	flags.IntVar(&opts.keyVersion, "key-version", currentKeyVersion, fmt.Sprintf("identify the archive with a key of version `N`: %d for 16 bytes, %d for 32 bytes, which older stubs ignore for the 16-byte one", keyV1, keyV2))
+	flags.BoolVar(&opts.contentKey, "content-key", false, "derive the key of the archive from its contents instead of a random one, so that rebuilds with the same contents reuse the extraction dirs of the previous ones, without encryption")
+	flags.BoolVar(&opts.reproducible, "reproducible", false, "write the same archive from the same inputs: owners are root, modification times are clamped to SOURCE_DATE_EPOCH or zeroed, and the key is derived from the contents, as with -content-key")
+	encryptFlg := flags.Bool("encrypt", false, "encrypt the payload with AES-256-GCM, with a passphrase from "+EnvPassphrase+" or asked on the terminal")
+	flags.StringVar(&opts.escrow, "escrow", "", "append the key, digest and encryption settings of the archive to `FILE`, as a line of JSON, for the records of its publisher")
+	flags.Var((*stringList)(&opts.encryptFiles), "encrypt-files", "encrypt the contents of the files matching `GLOB` like -encrypt does, leaving the rest of the payload readable (repeatable)")
+	flags.IntVar(&opts.jobs, "j", 0, "compress with zstd on `N` threads, 1 for a single zstd frame (default: all the cores)")
+	flags.IntVar(&opts.level, "level", 0, "compress with zstd level `N`, from 1 (fastest, the default) to 22 (smallest)")
+	flags.StringVar(&opts.packStub, "pack-stub", "", "shrink the stub with the executable packer `COMMAND`, run with the path of the stub to pack in place, e.g. \"upx --best --lzma\"")
+	flags.Var(&opts.long, "long", "use a large compression window of 2^WINDOWLOG bytes (default 27) to find matches far apart, as -long or -long=WINDOWLOG")
+	verboseFlg := flags.Bool("v", false, "verbose output")
+	veryVerboseFlg := flags.Bool("vv", false, "very verbose output, with per-file compression statistics")
+	versionFlg := flags.Bool("version", false, "print version and exit")
+	flags.Parse(args)
+	veryVerbose = *veryVerboseFlg
+	verbose = verbose || *verboseFlg || veryVerbose
+
+	if *versionFlg {
+		fmt.Println(currentBuildInfo())
+		return
+	}
+	for _, pattern := range opts.exclude {
+		err := checkPattern(pattern)
+		if err != nil {
+			die("-exclude:", err)
+		}
+	}
+	for _, name := range excludeFrom {
+		patterns, err := readPatterns(name)
+		if err != nil {
+			die("reading patterns to exclude from", name+":", err)
+		}
+		opts.exclude = append(opts.exclude, patterns...)
+	}
+	opts.files = parseInputFiles(opts.dir, flags.Args())
+	for _, name := range fileLists {
+		if name == "-" && opts.fromTar == "-" {
+			die("-T - and -from-tar - can't both read stdin")
+		}
+		paths, err := readFileList(name)
+		if err != nil {
+			die("reading list of files to archive:", err)
+		}
+		debug("archiving", len(paths), "files listed in", name)
+		for _, p := range paths {
+			opts.files = append(opts.files, newInputFile(opts.dir, p))
+		}
+	}
+	if (opts.long != 0 || opts.level != 0 || opts.jobs != 0) && opts.compression != "" && opts.compression != "zstd" {
+		die("-long, -level and -j only apply to zstd compression")
+	}
+	if opts.jobs < 0 {
+		die("-j must be at least 1")
+	}
+	if opts.settings.Cmd != "" {
+		args, err := shlex.Split(opts.settings.Cmd)
+		if err != nil {
+			die("-cmd:", err)
+		}
+		if len(args) == 0 {
+			die("-cmd: empty command line")
+		}
+	}
+	for _, entry := range entries {
+		name, cmdline, ok := strings.Cut(entry, "=")
+		if !ok {
+			die("-entry: expected NAME=CMDLINE:", entry)
+		}
+		err := checkUsageName(name)
+		if err != nil {
+			die("-entry:", err)
+		}
+		if _, ok := opts.settings.Entries[name]; ok {
+			die("-entry: duplicate entrypoint", name)
+		}
+		args, err := shlex.Split(cmdline)
+		if err != nil {
+			die("-entry", name+":", err)
+		}
+		if len(args) == 0 {
+			die("-entry", name+": empty command line")
+		}
+		if opts.settings.Entries == nil {
+			opts.settings.Entries = make(map[string]string)
+		}
+		opts.settings.Entries[name] = cmdline
+	}
+	for _, kv := range opts.settings.Env {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok {
+			die("-env: expected NAME=VALUE:", kv)
+		}
+		err := checkEnvName(name)
+		if err != nil {
+			die("-env:", err)
+		}
+		if strings.ContainsRune(kv, 0) {
+			die("-env: NUL character in", name)
+		}
+	}
+	if opts.settings.EnvPrefix != "" {
+		err := checkEnvPrefix(opts.settings.EnvPrefix)
+		if err != nil {
+			die("-env-prefix:", err)
+		}
+	}
+	if opts.settings.Server && opts.settings.Exec {
+		die("-server and -exec are mutually exclusive")
+	}
+	if len(opts.settings.AllowedDirs) > 0 && opts.settings.NoDirOverride {
+		die("-allow-dir and -no-dir-override are mutually exclusive")
+	}
+	for _, dir := range opts.settings.AllowedDirs {
+		if !isAbsPath(dir) {
+			die("-allow-dir must be an absolute path:", dir)
+		}
+	}
+	if *expiresFlg != "" {
+		expires, err := parseExpiry(*expiresFlg)
+		if err != nil {
+			die("-expires:", err)
+		}
+		if expires.Before(clock.Now()) {
+			warn("the archive is already expired")
+		}
+		opts.settings.Expires = &expires
+	}
+	if (opts.settings.RevocationURL == "") != (*revocationKeyFlg == "") {
+		die("-revocation-url and -revocation-key go together")
+	}
+	if opts.settings.RevocationRequired && opts.settings.RevocationURL == "" {
+		die("-revocation-required only applies with -revocation-url")
+	}
+	if opts.settings.RevocationURL != "" {
+		u, err := url.Parse(opts.settings.RevocationURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			die("-revocation-url must be an http or https URL:", opts.settings.RevocationURL)
+		}
+		opts.settings.RevocationKey, err = readPublicKey(*revocationKeyFlg)
+		if err != nil {
+			die("-revocation-key:", err)
+		}
+		if *revocationMaxAgeFlg < 0 || *revocationIntervalFlg < 0 {
+			die("-revocation-max-age and -revocation-interval can't be negative")
+		}
+		opts.settings.RevocationMaxAge = *revocationMaxAgeFlg
+		opts.settings.RevocationInterval = *revocationIntervalFlg
+	}
+	if opts.settings.CountRuns != "" {
+		err := checkUsageName(opts.settings.CountRuns)
+		if err != nil {
+			die("-count-runs:", err)
+		}
+	}
+	if len(opts.settings.KeepEnv) > 0 && !opts.settings.ScrubEnv {
+		die("-keep-env only applies with -scrub-env")
+	}
+	if opts.level < 0 || opts.level > 22 {
+		die("compression level must be between 1 and 22")
+	}
+	if opts.keyVersion != keyV1 && opts.keyVersion != keyV2 {
+		die("unsupported key version:", opts.keyVersion)
+	}
+	for _, pattern := range opts.encryptFiles {
+		err := checkPattern(pattern)
+		if err != nil {
+			die("-encrypt-files:", err)
+		}
+	}
+	if opts.contentKey && (*encryptFlg || len(opts.encryptFiles) > 0) {
+		die("-content-key is incompatible with -encrypt and -encrypt-files, encryption is salted so the key would change at each build")
+	}
+	if opts.reproducible {
+		if *encryptFlg || len(opts.encryptFiles) > 0 {
+			die("-reproducible is incompatible with -encrypt and -encrypt-files, encryption is salted")
+		}
+		var err error
+		opts.sourceDate, err = sourceDateEpoch()
+		if err != nil {
+			die(err)
+		}
+		opts.contentKey = true
+	}
+	if *encryptFlg {
+		var err error
+		opts.passphrase, err = readPassphrase(true)
+		if err != nil {
+			die("reading passphrase:", err)
+		}
+	}
+	if len(opts.encryptFiles) > 0 {
+		// the same passphrase as the payload, typed once
+		var err error
+		opts.filesPassphrase, err = readPassphrase(true)
+		if err != nil {
+			die("reading passphrase:", err)
+		}
+	}
+
+	self.Seek(0, os.SEEK_SET)
+	create(self, nil, opts)
+}
+
+// parseExpiry reads an expiry date, either a day, which expires at its end in
+// UTC, or an RFC 3339 time.
+func parseExpiry(s string) (time.Time, error) {
+	day, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return day.AddDate(0, 0, 1), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected YYYY-MM-DD or an RFC 3339 time: %q", s)
+	}
+	return t, nil
+}
+
+// readPublicKey reads an ed25519 public key from a PEM file, as written by
+// openssl pkey -pubout.
+func readPublicKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("not a public key: %s", path)
+	}
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 public key: %s", path)
+	}
+	return pubKey, nil
+}
+
+// windowLog is the base-2 log of the zstd window size. As a flag, it can be
+// given without a value to use defaultWindowLog.
+type windowLog int
+
+const defaultWindowLog = 27
+
+func (w *windowLog) IsBoolFlag() bool {
+	return true
+}
+
+func (w *windowLog) String() string {
+	if *w == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*w))
+}
+
+func (w *windowLog) Set(s string) error {
+	switch s {
+	case "true":
+		*w = defaultWindowLog
+		return nil
+	case "false":
+		*w = 0
+		return nil
+	}
+	// checked before shifting, which overflows from 63
+	maxLog := bits.Len(zstd.MaxWindowSize) - 1
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 10 || n > maxLog {
+		return fmt.Errorf("window log must be between 10 and %d", maxLog)
+	}
+	*w = windowLog(n)
+	return nil
+}
+
+// keyValues is a flag setting KEY=VALUE pairs.
+type keyValues map[string]string
+
+func (kv *keyValues) String() string {
+	var pairs []string
+	for k, v := range *kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv *keyValues) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected KEY=VALUE: %q", s)
+	}
+	if *kv == nil {
+		*kv = make(map[string]string)
+	}
+	(*kv)[k] = v
+	return nil
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
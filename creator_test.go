@@ -0,0 +1,49 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"math/bits"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWindowLogSet(t *testing.T) {
+	maxLog := bits.Len(zstd.MaxWindowSize) - 1
+	for _, tc := range []struct {
+		value string
+		want  windowLog
+		ok    bool
+	}{
+		{"true", defaultWindowLog, true},
+		{"false", 0, true},
+		{"10", 10, true},
+		{"27", 27, true},
+		{"9", 0, false},
+		{"-1", 0, false},
+		{"x", 0, false},
+		{"63", 0, false},
+		{"64", 0, false},
+		{"100", 0, false},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			var w windowLog
+			err := w.Set(tc.value)
+			if (err == nil) != tc.ok || w != tc.want {
+				t.Errorf("got %d and error %v, want %d and ok %v", w, err, tc.want, tc.ok)
+			}
+		})
+	}
+
+	var w windowLog
+	err := w.Set(strconv.Itoa(maxLog))
+	if err != nil || int(w) != maxLog {
+		t.Errorf("max window log %d refused: %v", maxLog, err)
+	}
+	err = w.Set(strconv.Itoa(maxLog + 1))
+	if err == nil {
+		t.Errorf("window log %d above the max accepted", maxLog+1)
+	}
+}
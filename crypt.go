@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Encrypted payloads are the compressed tar encrypted with AES-256-GCM, with a
+// key derived from a passphrase with scrypt. They start with a header made of
+// encryptionMagic and the salt of the key, followed by chunks of
+// encryptionChunkSize bytes of data, each sealed with its own nonce: the
+// 11-byte big-endian index of the chunk, then 1 for the last chunk or 0. This
+// lets the stub decrypt the payload on the fly, while detecting truncated or
+// reordered chunks.
+var encryptionMagic = []byte("SFXAES1\x00")
+
+const (
+	encryptionSaltSize  = 16
+	encryptionChunkSize = 64 << 10
+)
+
+func encryptionKey(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, last bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// typedPassphrase is the passphrase asked on the terminal, so that it is asked
+// once when the payload is read several times.
+var typedPassphrase []byte
+
+// readPassphrase gets the passphrase of an encrypted payload from the
+// environment, or asks for it on a terminal, twice if confirm is set.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(EnvPassphrase); ok {
+		return []byte(passphrase), nil
+	}
+	if typedPassphrase != nil {
+		return typedPassphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no passphrase, set %s", EnvPassphrase)
+	}
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "passphrase again: ")
+		again, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+	typedPassphrase = passphrase
+	return passphrase, nil
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	nonce []byte
+}
+
+// newEncryptWriter encrypts what is written to it into w. It must be closed
+// to write the last chunk.
+func newEncryptWriter(w io.Writer, passphrase []byte) (io.WriteCloser, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := io.ReadFull(randomSource, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := encryptionKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append(append([]byte(nil), encryptionMagic...), salt...))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		buf:   make([]byte, 0, encryptionChunkSize+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes, as the last one
+		// is sealed differently
+		if len(e.buf) == encryptionChunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return n, err
+			}
+		}
+		m := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(e.buf[:0], chunkNonce(e.nonce, e.index, last), e.buf, nil)
+	e.index++
+	_, err := e.w.Write(sealed)
+	e.buf = e.buf[:0]
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	index uint64
+	nonce []byte
+	done  bool
+}
+
+// newDecryptReader decrypts an encrypted payload, with its header.
+func newDecryptReader(r io.Reader, passphrase []byte) (io.Reader, error) {
+	header := make([]byte, len(encryptionMagic)+encryptionSaltSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, encryptionMagic) {
+		return nil, errors.New("payload is not encrypted")
+	}
+	aead, err := encryptionKey(passphrase, header[len(encryptionMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		buf:   make([]byte, encryptionChunkSize+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		}
+		d.plain, err = d.aead.Open(d.buf[:0], chunkNonce(d.nonce, d.index, d.done), d.buf[:n], nil)
+		if err != nil {
+			if d.index == 0 {
+				return 0, errors.New("wrong passphrase, or corrupted payload")
+			}
+			return 0, fmt.Errorf("corrupted payload in chunk %d", d.index)
+		}
+		d.index++
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
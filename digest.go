@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// The SHA-256 digest of the compressed payload is recorded in a trailing
+// block, so that corrupted archives, e.g. truncated or altered downloads, are
+// reported as such before anything is extracted, rather than by confusing
+// decompression errors halfway through.
+
+func digestBlock(sum []byte) trailingBlock {
+	return trailingBlock{typ: blockPayloadDigest, data: sum}
+}
+
+// payloadDigest returns the digest recorded in the archive, if any.
+func payloadDigest(blocks []trailingBlock) ([]byte, bool) {
+	for _, b := range blocks {
+		if b.typ == blockPayloadDigest && len(b.data) == sha256.Size {
+			return b.data, true
+		}
+	}
+	return nil, false
+}
+
+// verifyPayload checks the payload against its recorded digest, and leaves it
+// ready to be read again. Nothing has been extracted yet when it fails.
+func (se *selfExtractor) verifyPayload() {
+	want, ok := payloadDigest(se.blocks)
+	if !ok {
+		debug("archive has no payload digest, not verifying it")
+		return
+	}
+	payload, ok := se.payload.(io.ReadSeeker)
+	if !ok {
+		debug("payload can't be read twice, not verifying it")
+		return
+	}
+	defer timePhase("verify")()
+	readAhead(se.payload)
+
+	err := checkDigest(payload, want)
+	if err != nil {
+		die(err)
+	}
+	debug("payload digest verified")
+}
+
+// checkDigest checks a payload against its recorded digest, and seeks back to
+// its start.
+func checkDigest(payload io.ReadSeeker, want []byte) error {
+	h := sha256.New()
+	_, err := io.Copy(h, payload)
+	if err != nil {
+		return fmt.Errorf("reading payload: %w", err)
+	}
+	_, err = payload.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("seeking to start of payload: %w", err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("archive is corrupted: payload digest is %s instead of %s", hex.EncodeToString(got), hex.EncodeToString(want))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkExtractDir returns an error if the archive doesn't allow extracting to
+// dir when it is set in the environment. Symlinks are resolved, so that a
+// link in an allowed dir can't point elsewhere.
+func (s archiveSettings) checkExtractDir(dir string) error {
+	if s.NoDirOverride {
+		return fmt.Errorf("the archive doesn't allow setting %s, it only extracts to temporary dirs", EnvDir)
+	}
+	if len(s.AllowedDirs) == 0 {
+		return nil
+	}
+	real, err := resolvePath(dir)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", EnvDir, err)
+	}
+	for _, allowed := range s.AllowedDirs {
+		prefix, err := resolvePath(allowed)
+		if err != nil {
+			debug("resolving allowed extraction dir", allowed+":", err)
+			continue
+		}
+		rel, err := filepath.Rel(prefix, real)
+		if err == nil && isLocalPath(rel) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be inside %s: %s", EnvDir, strings.Join(s.AllowedDirs, " or "), dir)
+}
+
+// checkDirOverride dies if the extraction dir set in the environment isn't
+// allowed by the archive, before anything is created.
+func (se *selfExtractor) checkDirOverride() {
+	dir := os.Getenv(EnvDir)
+	if dir == "" {
+		return
+	}
+	err := se.settings.checkExtractDir(dir)
+	if err != nil {
+		die(err)
+	}
+}
+
+// resolvePath returns the absolute path of path, with the symlinks of its
+// existing part resolved.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	existing := existingParent(path)
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	rest, err := filepath.Rel(existing, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, rest), nil
+}
+
+// allowedDirsValue describes the extraction dirs the archive can be given.
+func allowedDirsValue(settings archiveSettings) string {
+	switch {
+	case settings.NoDirOverride:
+		return "none, temporary dirs only"
+	case len(settings.AllowedDirs) > 0:
+		return strings.Join(settings.AllowedDirs, ", ")
+	}
+	return "any"
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// payloadSizeBlock returns the trailing block recording the uncompressed size
+// of the payload, which is about the space its extraction takes.
+func payloadSizeBlock(size int64) trailingBlock {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(size))
+	return trailingBlock{typ: blockPayloadSize, data: data}
+}
+
+// payloadSize returns the uncompressed size of the payload recorded in the
+// archive, if any.
+func payloadSize(blocks []trailingBlock) (uint64, bool) {
+	for _, b := range blocks {
+		if b.typ == blockPayloadSize && len(b.data) == 8 {
+			return binary.LittleEndian.Uint64(b.data), true
+		}
+	}
+	return 0, false
+}
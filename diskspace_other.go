@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package main
+
+import (
+	"errors"
+)
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space not supported on this platform")
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns the space available to the current user on the volume of
+// dir.
+func freeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	err = windows.GetDiskFreeSpaceEx(path, &avail, nil, nil)
+	return avail, err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// dump writes the payload to stdout, for the archive to be converted back to
+// a regular one or piped into tar: as stored in the archive, e.g. a .tar.zst,
+// or decompressed to a plain tar if decompress is set.
+func (se *selfExtractor) dump(decompress bool) {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		die("not writing the payload to a terminal, redirect the output")
+	}
+	readAhead(se.payload)
+	r := se.payload
+	if decompress {
+		zRdr, err := newDecompressor(se.payload, se.blocks)
+		if err != nil {
+			die("reading payload:", err)
+		}
+		defer zRdr.Close()
+		r = zRdr
+	}
+	_, err := io.Copy(os.Stdout, r)
+	if err != nil {
+		die("writing payload:", err)
+	}
+}
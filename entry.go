@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// entryNames returns the names of the entrypoints of the archive, sorted.
+func entryNames(settings archiveSettings) []string {
+	var names []string
+	for name := range settings.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectEntry returns the entrypoint of the archive to run, chosen with
+// SELFEXTRACT_ENTRY or, as busybox does, by the name the archive is run as,
+// e.g. through a symlink. It returns "" when none is chosen, for the archive
+// to run its command as usual.
+func (se *selfExtractor) selectEntry() string {
+	if name := os.Getenv(EnvEntry); name != "" {
+		if _, ok := se.settings.Entries[name]; !ok {
+			if len(se.settings.Entries) == 0 {
+				die("unknown entrypoint", name+", the archive has none")
+			}
+			die("unknown entrypoint", name+", expected one of", strings.Join(entryNames(se.settings), ", "))
+		}
+		debug("entrypoint", name, "chosen with", EnvEntry)
+		return name
+	}
+	name := filepath.Base(os.Args[0])
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".exe") {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if _, ok := se.settings.Entries[name]; ok {
+		debug("entrypoint", name, "chosen by the name of the archive")
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envVars are the environment variables read or set by the stub, which are
+// renamed by the environment prefix of the archive.
+var envVars = []*string{
+	&EnvVerbose, &EnvDir, &EnvStartup, &EnvCmdline, &EnvExtractOnly,
+	&EnvGraceTimeout, &EnvAllowTrailing, &EnvOnConflict, &EnvMerge,
+	&EnvAuditFile, &EnvStatusFile, &EnvLogDir, &EnvLogMaxSize, &EnvLogTee,
+	&EnvFirstRun, &EnvKeepTmp, &EnvOwnerMap, &EnvGroupMap, &EnvPassphrase,
+	&EnvPreserveSpecialBits, &EnvPreserveOwner, &EnvNoMtime, &EnvPrecreateDirs,
+	&EnvAllowUnsafePaths, &EnvExec, &EnvScanBlockSize, &EnvReadBlockSize,
+	&EnvReadahead, &EnvJobs, &EnvPlan, &EnvRunCount, &EnvLastRun,
+	&EnvVerify, &EnvExitCode, &EnvCmd, &EnvEntry, &EnvServer, &EnvServerIdle,
+}
+
+var envPrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkEnvPrefix reports prefixes that can't start environment variable names.
+func checkEnvPrefix(prefix string) error {
+	if !envPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid environment prefix %q, expected letters, digits and underscores, not starting with a digit", prefix)
+	}
+	return nil
+}
+
+// checkEnvName reports names that can't name environment variables.
+func checkEnvName(name string) error {
+	if !envPrefixPattern.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q, expected letters, digits and underscores, not starting with a digit", name)
+	}
+	return nil
+}
+
+// setEnvPrefix renames the environment variables of the stub, e.g. to
+// MYAPP_SFX_DIR for the MYAPP_SFX_ prefix, so that archives of different
+// products are configured independently on the same machine.
+func setEnvPrefix(prefix string) {
+	for _, v := range envVars {
+		*v = prefix + strings.TrimPrefix(*v, envPrefix)
+	}
+	envPrefix = prefix
+	verbose = isTruthy(os.Getenv(EnvVerbose))
+	debug("using environment variables starting with", prefix)
+}
+
+// archiveEnvPrefix returns the environment prefix recorded in the settings of
+// the archive r. It finds them without reading any environment variable, e.g.
+// the block sizes used to search for the boundary, which the prefix renames:
+// only the archives locating their boundary without a search can have one.
+func archiveEnvPrefix(r io.ReadSeeker) string {
+	off, ok := trailerBoundary(r)
+	if !ok || !checkBoundary(r, off) {
+		off, ok = stampedBoundary()
+		if !ok || !checkBoundary(r, off) {
+			return ""
+		}
+	}
+	_, payloadOff, payloadSize, err := readHeader(r, off)
+	if err != nil {
+		return ""
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil || payloadSize > end-payloadOff {
+		return ""
+	}
+	blocks, err := readTrailingBlocks(r, payloadOff+payloadSize, end)
+	if err != nil {
+		// the data after the blocks is ignored with the ALLOW_TRAILING
+		// variable of the prefix
+		blocks = readLeadingBlocks(r, payloadOff+payloadSize, end)
+	}
+	var prefix string
+	for _, b := range blocks {
+		var s archiveSettings
+		if b.typ == blockSettings && json.Unmarshal(b.data, &s) == nil {
+			prefix = s.EnvPrefix
+		}
+	}
+	if checkEnvPrefix(prefix) != nil {
+		return ""
+	}
+	return prefix
+}
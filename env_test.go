@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestArchiveEnvPrefix(t *testing.T) {
+	stub := []byte("stub")
+	payload := []byte("payload")
+	archive := func(blocks ...trailingBlock) []byte {
+		var buf bytes.Buffer
+		buf.Write(stub)
+		buf.Write(header(uint64(len(payload))))
+		buf.Write(payload)
+		err := writeTrailingBlocks(&buf, blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	settings := func(s string) trailingBlock {
+		return trailingBlock{blockSettings, []byte(s)}
+	}
+	boundary := boundaryBlock(int64(len(stub)))
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"prefix", archive(settings(`{"env_prefix":"MYAPP_"}`), boundary), "MYAPP_"},
+		{"blocks after the boundary", archive(settings(`{"env_prefix":"MYAPP_"}`), boundary, trailingBlock{0x1234, []byte("sig")}), "MYAPP_"},
+		{"data after the blocks, unstamped", append(archive(settings(`{"env_prefix":"MYAPP_"}`), boundary), "other"...), ""},
+		{"no prefix", archive(settings(`{"exec":true}`), boundary), ""},
+		{"invalid settings", archive(settings(`{"env_prefix":`), boundary), ""},
+		{"invalid prefix", archive(settings(`{"env_prefix":"MY APP"}`), boundary), ""},
+		{"no boundary block", archive(settings(`{"env_prefix":"MYAPP_"}`)), ""},
+		{"truncated", archive(settings(`{"env_prefix":"MYAPP_"}`), boundaryBlock(0))[2:], ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := archiveEnvPrefix(bytes.NewReader(tc.data))
+			if got != tc.want {
+				t.Errorf("got prefix %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("data after the blocks, stamped", func(t *testing.T) {
+		prev := stamp
+		defer func() { stamp = prev }()
+		binary.LittleEndian.PutUint64(stamp[stampMarkerLen:], uint64(len(stub)))
+		data := append(archive(settings(`{"env_prefix":"MYAPP_"}`), boundary), "other"...)
+		if got := archiveEnvPrefix(bytes.NewReader(data)); got != "MYAPP_" {
+			t.Errorf("got prefix %q, want %q", got, "MYAPP_")
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envFileName is a file at the root of the payload setting variables in the
+// environment of the commands run, one NAME=VALUE per line, after the ones
+// given with -env.
+const envFileName = "selfextract_env"
+
+// injectedEnv returns the variables set in the environment of the commands
+// with -env and by the env file of the payload, as NAME=VALUE, in which
+// __EXTRACT_DIR__ is replaced by the extraction dir.
+func (se *selfExtractor) injectedEnv() []string {
+	se.envOnce.Do(func() {
+		vars := append([]string(nil), se.settings.Env...)
+		data, err := os.ReadFile(filepath.Join(se.extractDir, envFileName))
+		if err == nil {
+			vars = append(vars, parseEnvFile(data)...)
+		} else if !os.IsNotExist(err) {
+			warn("reading", envFileName+":", err)
+		}
+		for _, kv := range vars {
+			se.injected = append(se.injected, strings.ReplaceAll(kv, "__EXTRACT_DIR__", se.extractDir))
+		}
+	})
+	return se.injected
+}
+
+// parseEnvFile returns the NAME=VALUE lines of an env file, skipping the
+// blank ones and the # comments. Values are taken as they are, without
+// quotes nor expansion.
+func parseEnvFile(data []byte) []string {
+	var vars []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, ok := strings.Cut(line, "=")
+		if !ok || checkEnvName(name) != nil || strings.ContainsRune(line, 0) {
+			warn("ignoring invalid line", n, "of", envFileName+", expected NAME=VALUE")
+			continue
+		}
+		vars = append(vars, line)
+	}
+	return vars
+}
+
+// mergeEnv returns environ with the variables of vars set, replacing the ones
+// with the same names, since programs reading their environment without
+// libc may use the first occurrence of a name.
+func mergeEnv(environ, vars []string) []string {
+	set := make(map[string]bool, len(vars))
+	for _, kv := range vars {
+		name, _, _ := strings.Cut(kv, "=")
+		set[name] = true
+	}
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if !set[name] {
+			env = append(env, kv)
+		}
+	}
+	return append(env, vars...)
+}
@@ -0,0 +1,88 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// escrowRecord describes a created archive for the records of its publisher,
+// who may need its key to revoke it or its digest to recognize it later. It
+// holds no secret: passphrases are never recorded.
+type escrowRecord struct {
+	Archive    string    `json:"archive"`
+	Created    time.Time `json:"created"`
+	Key        string    `json:"key"`
+	KeyVersion int       `json:"key_version"`
+	// key of the archive header, which older stubs use, when it differs
+	HeaderKey        string   `json:"header_key,omitempty"`
+	PayloadSHA256    string   `json:"payload_sha256"`
+	PayloadSize      int64    `json:"payload_size"`
+	UncompressedSize uint64   `json:"uncompressed_size"`
+	Compression      string   `json:"compression"`
+	Encrypted        bool     `json:"encrypted,omitempty"`
+	EncryptedFiles   []string `json:"encrypted_files,omitempty"`
+	// the SHA-256 of the public key verifying the revocation list
+	RevocationURL string           `json:"revocation_url,omitempty"`
+	RevocationKey string           `json:"revocation_key,omitempty"`
+	Expires       *time.Time       `json:"expires,omitempty"`
+	Metadata      *archiveMetadata `json:"metadata,omitempty"`
+}
+
+// newEscrowRecord describes the archive written with the options, from its
+// trailing blocks, which also hold the settings kept by rewrap.
+func newEscrowRecord(archive string, headerKey []byte, blocks []trailingBlock, opts createOptions) escrowRecord {
+	key, _ := archiveKey(headerKey, blocks)
+	settings := loadSettings(blocks)
+	rec := escrowRecord{
+		Archive:     archive,
+		Created:     clock.Now().UTC(),
+		Key:         hex.EncodeToString(key),
+		KeyVersion:  keyVersion(key),
+		Compression: string(opts.compression),
+		Encrypted:   opts.passphrase != nil,
+		Expires:     settings.Expires,
+	}
+	if rec.Compression == "" {
+		rec.Compression = defaultCompression
+	}
+	if rec.KeyVersion != keyV1 {
+		rec.HeaderKey = hex.EncodeToString(headerKey)
+	}
+	if sum, ok := payloadDigest(blocks); ok {
+		rec.PayloadSHA256 = hex.EncodeToString(sum)
+	}
+	rec.UncompressedSize, _ = payloadSize(blocks)
+	if settings.RevocationURL != "" {
+		sum := sha256.Sum256(settings.RevocationKey)
+		rec.RevocationURL = settings.RevocationURL
+		rec.RevocationKey = hex.EncodeToString(sum[:])
+	}
+	if m, ok := loadMetadata(blocks); ok {
+		rec.Metadata = &m
+	}
+	return rec
+}
+
+// appendEscrow appends a record to the escrow file at path, one JSON object
+// per line, so that a file can keep the records of every build.
+func appendEscrow(path string, rec escrowRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// execSupported tells whether the stub can replace itself by the command.
+const execSupported = true
+
+// execReplace replaces the process by the program at path, and only returns
+// on failure.
+func execReplace(path string, args, env []string) error {
+	return syscall.Exec(path, args, env)
+}
+
+// killingSignal returns the signal that killed a process, if any.
+func killingSignal(state *os.ProcessState) (syscall.Signal, bool) {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return ws.Signal(), true
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// execSupported tells whether the stub can replace itself by the command,
+// which Windows can't do.
+const execSupported = false
+
+func execReplace(path string, args, env []string) error {
+	return errors.New("replacing the process isn't supported on Windows")
+}
+
+// killingSignal returns the signal that killed a process, which never
+// happens on Windows.
+func killingSignal(state *os.ProcessState) (syscall.Signal, bool) {
+	return 0, false
+}
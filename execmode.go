@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// execMode tells whether the command is run in place of the stub rather than
+// as its child, which saves a process for archives that don't need the stub
+// once the command started. The stub must then have nothing left to do after
+// the command: it runs it as a child otherwise.
+func (se *selfExtractor) execMode() bool {
+	if !se.settings.Exec && !isTruthy(os.Getenv(EnvExec)) {
+		return false
+	}
+	var reason string
+	switch {
+	case !execSupported:
+		reason = "isn't supported on this platform"
+	case se.tempDir:
+		reason = "would leave the temporary extraction dir behind, set " + EnvDir
+	case os.Getenv(EnvLogDir) != "":
+		reason = "can't write the output of the command to " + EnvLogDir
+	case os.Getenv(EnvStatusFile) != "":
+		reason = "can't write the status file with the exit code of the command"
+	default:
+		return true
+	}
+	warn("running the command as a child, since replacing the process by it", reason)
+	return false
+}
+
+// execCommand replaces the stub by the command. It only returns if the
+// command couldn't be executed.
+func (se *selfExtractor) execCommand(cmd *exec.Cmd, what string) {
+	env := cmd.Env
+	if env == nil {
+		env = se.childEnv()
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	se.recordAudit(cmd.Args)
+	debug("timings:", timings.summary())
+	reportWarnings()
+	debug("replacing the process by the", what)
+	err := execReplace(cmd.Path, cmd.Args, env)
+	debug(what, "failed to execute:", err)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// revocationTimeout is how long fetching the revocation list can take.
+const revocationTimeout = 10 * time.Second
+
+// revocationListMax is the size of the largest revocation list read.
+const revocationListMax = 16 << 20
+
+// checkExpiry dies if the archive is past its expiry date.
+func (se *selfExtractor) checkExpiry() {
+	expires := se.settings.Expires
+	if expires == nil || clock.Now().Before(*expires) {
+		return
+	}
+	die(msg("expired", "{date}", expires.Format(time.RFC3339)))
+}
+
+// checkRevocation dies if the key of the archive is in the revocation list of
+// the archive, if it has one. The list is a text file of the hex keys of the
+// revoked archives, one per line, and of the date it was published on a
+// "date:" line, signed with ed25519 in a file of the same URL with a .sig
+// suffix, holding the signature in binary or base64. Lists older than
+// RevocationMaxAge, or than the last one checked, are refused, so that an old
+// list can't be replayed. Archives still run when the list can't be checked,
+// unless it is required, and don't check it again for RevocationInterval once
+// they weren't revoked.
+func (se *selfExtractor) checkRevocation() {
+	url := se.settings.RevocationURL
+	if url == "" {
+		return
+	}
+	now := clock.Now()
+	path, err := revocationCheckPath(se.key)
+	if err != nil {
+		debug("can't record revocation checks:", err)
+	}
+	last := readRevocationCheck(path)
+	interval := se.settings.RevocationInterval
+	if interval > 0 && !now.Before(last.Checked) && now.Sub(last.Checked) < interval &&
+		checkRevocationDate(last.Date, time.Time{}, now, se.settings.RevocationMaxAge) == nil {
+		debug("archive was not revoked at", last.Checked.Format(time.RFC3339))
+		return
+	}
+
+	revoked, date, err := fetchRevocations(url, se.settings.RevocationKey)
+	if err == nil {
+		err = checkRevocationDate(date, last.Date, now, se.settings.RevocationMaxAge)
+	}
+	if err != nil {
+		if se.settings.RevocationRequired {
+			die("checking revocation list:", err)
+		}
+		warn("could not check revocation list:", err)
+		return
+	}
+	keys := append([][]byte{se.key}, se.previousKeys...)
+	for _, key := range keys {
+		if revoked[hex.EncodeToString(key)] {
+			die(msg("revoked"))
+		}
+	}
+	debug("archive is not revoked, as of the revocation list of", date.Format(time.RFC3339))
+	if path != "" {
+		err = writeRevocationCheck(path, revocationCheck{Checked: now, Date: date})
+		if err != nil {
+			debug("can't record revocation check:", err)
+		}
+	}
+}
+
+// checkRevocationDate reports revocation lists published before the last one
+// checked, or more than maxAge ago, unless it is zero.
+func checkRevocationDate(date, last, now time.Time, maxAge time.Duration) error {
+	if maxAge > 0 && now.Sub(date) > maxAge {
+		return fmt.Errorf("revocation list of %s is older than %s", date.Format(time.RFC3339), maxAge)
+	}
+	if date.Before(last) {
+		return fmt.Errorf("revocation list of %s is older than the one of %s checked before", date.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// fetchRevocations returns the keys of the revocation list at url, and the
+// date of the list, once its signature is verified with pubKey.
+func fetchRevocations(url string, pubKey []byte) (map[string]bool, time.Time, error) {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return nil, time.Time{}, fmt.Errorf("invalid public key of revocation list")
+	}
+	list, err := fetch(url)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	sig, err := fetch(url + ".sig")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("decoding signature of revocation list: %w", err)
+		}
+	}
+	if !ed25519.Verify(pubKey, list, sig) {
+		return nil, time.Time{}, fmt.Errorf("invalid signature of revocation list")
+	}
+	return parseRevocations(list)
+}
+
+// parseRevocations returns the keys of a revocation list, and its date.
+func parseRevocations(list []byte) (map[string]bool, time.Time, error) {
+	revoked := make(map[string]bool)
+	var date time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "date:") {
+			if !date.IsZero() {
+				return nil, time.Time{}, errors.New("revocation list has several dates")
+			}
+			var err error
+			date, err = time.Parse(time.RFC3339, strings.TrimSpace(strings.TrimPrefix(line, "date:")))
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("invalid date of revocation list: %w", err)
+			}
+			continue
+		}
+		revoked[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	if date.IsZero() {
+		return nil, time.Time{}, errors.New("revocation list has no date")
+	}
+	return revoked, date, nil
+}
+
+// revocationCheck is the last check of the revocation list finding that an
+// archive wasn't revoked, kept as JSON in the state dir.
+type revocationCheck struct {
+	Checked time.Time `json:"checked"`
+	Date    time.Time `json:"date"` // of the list
+}
+
+// revocationCheckPath returns the file recording the last revocation check of
+// the archive of the given key.
+func revocationCheckPath(key []byte) (string, error) {
+	dir, err := userStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "revocation", hex.EncodeToString(key)+".json"), nil
+}
+
+// readRevocationCheck returns the check recorded at path, or none if it can't
+// be read.
+func readRevocationCheck(path string) revocationCheck {
+	var c revocationCheck
+	if path == "" {
+		return c
+	}
+	data, err := os.ReadFile(path)
+	if err == nil && json.Unmarshal(data, &c) != nil {
+		debug("ignoring invalid", path)
+		return revocationCheck{}
+	}
+	return c
+}
+
+// writeRevocationCheck replaces the check recorded at path.
+func writeRevocationCheck(path string, c revocationCheck) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// fetch downloads url with curl, which ships with Linux distributions, macOS
+// and Windows: an HTTP client would double the size of the stub.
+func fetch(url string) ([]byte, error) {
+	cmd := exec.Command("curl", "--fail", "--silent", "--show-error", "--location",
+		"--max-time", strconv.Itoa(int(revocationTimeout.Seconds())),
+		"--max-filesize", strconv.Itoa(revocationListMax), "--", url)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("curl is needed to download %s: %w", url, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v: %s", url, err, strings.TrimSpace(stderr.String()))
+	}
+	return data, nil
+}
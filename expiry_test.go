@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRevocations(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		list string
+		keys int
+		err  string
+	}{
+		{"keys", "# revoked\ndate: 2030-01-01T00:00:00Z\nAB01\n\ncd02\n", 2, ""},
+		{"no keys", "date: 2030-01-01T00:00:00Z\n", 0, ""},
+		{"no date", "ab01\n", 0, "has no date"},
+		{"commented date", "# date: 2030-01-01T00:00:00Z\nab01\n", 0, "has no date"},
+		{"invalid date", "date: 2030-01-01\n", 0, "invalid date"},
+		{"several dates", "date: 2030-01-01T00:00:00Z\ndate: 2030-01-02T00:00:00Z\n", 0, "several dates"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			revoked, date, err := parseRevocations([]byte(tc.list))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revoked) != tc.keys || (tc.keys > 0 && !revoked["ab01"]) {
+				t.Errorf("got keys %v", revoked)
+			}
+			if !date.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("got date %v", date)
+			}
+		})
+	}
+}
+
+func TestCheckRevocationDate(t *testing.T) {
+	now := time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		date   time.Time
+		last   time.Time
+		maxAge time.Duration
+		err    string
+	}{
+		{"fresh", now.Add(-time.Hour), time.Time{}, 24 * time.Hour, ""},
+		{"too old", now.Add(-25 * time.Hour), time.Time{}, 24 * time.Hour, "older than 24h0m0s"},
+		{"no max age", now.AddDate(-1, 0, 0), time.Time{}, 0, ""},
+		{"same as last", now.Add(-time.Hour), now.Add(-time.Hour), 24 * time.Hour, ""},
+		{"older than last", now.Add(-2 * time.Hour), now.Add(-time.Hour), 24 * time.Hour, "checked before"},
+		{"in the future", now.Add(time.Hour), time.Time{}, 24 * time.Hour, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkRevocationDate(tc.date, tc.last, now, tc.maxAge)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckRevocationInterval(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+	now := time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		checked time.Time
+		date    time.Time
+		fetched bool // whether the list is downloaded again
+	}{
+		{"within the interval", now.Add(-30 * time.Minute), now.Add(-2 * time.Hour), false},
+		{"after the interval", now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), true},
+		{"list too old", now.Add(-30 * time.Minute), now.Add(-25 * time.Hour), true},
+		{"checked in the future", now.Add(time.Hour), now.Add(-2 * time.Hour), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useClock(t, &fakeClock{now: now})
+			se := &selfExtractor{key: []byte(tc.name)}
+			// the list can't be downloaded, which fails when it is tried
+			se.settings.RevocationURL = "http://127.0.0.1:1/revoked"
+			se.settings.RevocationKey = make([]byte, ed25519.PublicKeySize)
+			se.settings.RevocationRequired = true
+			se.settings.RevocationMaxAge = 24 * time.Hour
+			se.settings.RevocationInterval = time.Hour
+			path, err := revocationCheckPath(se.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = writeRevocationCheck(path, revocationCheck{Checked: tc.checked, Date: tc.date})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fatal := catchDie(se.checkRevocation)
+			if fetched := strings.Contains(fatal, "checking revocation list"); fetched != tc.fetched {
+				t.Errorf("got fatal error %q, want the list downloaded: %v", fatal, tc.fetched)
+			}
+		})
+	}
+}
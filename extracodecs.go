@@ -0,0 +1,58 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// The codecs other than zstd are left out of the stubs built with the
+// stubonly tag, which they would make larger by about 300 kB. Those stubs
+// don't list them in their capabilities, so rewrap -stub refuses to make
+// archives they couldn't extract.
+
+const extraCodecCapabilities = "gzip,xz,lz4,"
+
+func init() {
+	registerCodec("gzip", gzipCodec{})
+	registerCodec("xz", xzCodec{})
+	registerCodec("lz4", lz4Codec{})
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+func (gzipCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type xzCodec struct{}
+
+func (xzCodec) magic() []byte {
+	return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+}
+
+func (xzCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	xzRdr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(xzRdr), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) magic() []byte {
+	return []byte{0x04, 0x22, 0x4d, 0x18}
+}
+
+func (lz4Codec) newReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
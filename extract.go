@@ -2,19 +2,23 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
 	"github.com/google/shlex"
 )
 
@@ -24,27 +28,162 @@ type selfExtractor struct {
 	extractDir  string
 	skipExtract bool
 	tempDir     bool
+	merge       bool // extract over the contents of the extraction dir
+	extractOnly bool
 	payload     io.Reader
+	rawPayload  *filePayload // payload of files stored as is, if any
 	key         []byte
+	blocks      []trailingBlock
+	settings    archiveSettings // chosen when creating the archive
 	exitCode    chan int
+	opts        map[string]string // reserved --selfextract-* options
+	args        []string          // arguments forwarded to the payload command
+	entry       string            // entrypoint to run instead of the command
+	runCounted  bool              // countRun already counted this run
+
+	// variables set in the environment of the commands, see injectedEnv
+	envOnce  sync.Once
+	injected []string
+
+	decompressTime time.Duration // time spent reading the payload
+	ownerMap       idMap         // owners of the extracted files, as root
+	groupMap       idMap
+	preserveOwner  bool       // chown to the recorded owners, as root
+	writes         *writePool // files being written, while extracting
+	errors         []string   // non-fatal errors, for the status report
+
+	// keys of previous versions identifying the archive, see archiveKey
+	previousKeys [][]byte
+
+	// keep the setuid, setgid and sticky bits of the extracted files
+	preserveSpecialBits bool
+	// leave the extracted files with the time of the extraction
+	noMtime bool
+	// extract the entries of trusted archives wherever they point
+	allowUnsafePaths bool
+
+	childMu  sync.Mutex
+	children []*os.Process
+	// commands not waited for yet, whose output may still be copied to the
+	// log files
+	running sync.WaitGroup
+
+	// where the payload commands write their output
+	logOnce sync.Once
+	stdout  io.Writer
+	stderr  io.Writer
+	logErr  error
 }
 
-func extract(payload io.Reader, key []byte) {
+func extract(payload io.Reader, key []byte, blocks []trailingBlock) {
 	se := selfExtractor{
 		payload:  payload,
-		key:      key,
+		blocks:   blocks,
 		exitCode: make(chan int),
 	}
+	se.key, se.previousKeys = archiveKey(key, blocks)
+	loadMessages(blocks)
+	se.settings = loadSettings(blocks)
+	se.opts, se.args = parseStubArgs(os.Args[1:])
+	se.extractOnly = isTruthy(os.Getenv(EnvExtractOnly))
+
+	if _, ok := se.opts["version"]; ok {
+		se.printVersion()
+		return
+	}
+	if _, ok := se.opts["help"]; ok {
+		se.printHelp()
+		return
+	}
+	if _, ok := se.opts["list"]; ok {
+		se.list()
+		return
+	}
+	if _, ok := se.opts["metadata"]; ok {
+		se.printMetadata()
+		return
+	}
+	if _, ok := se.opts["dump"]; ok {
+		se.dump(false)
+		return
+	}
+	if _, ok := se.opts["dump-tar"]; ok {
+		se.dump(true)
+		return
+	}
+	if _, ok := se.opts["config"]; ok {
+		compression, _, err := detectCompression(se.payload, se.blocks)
+		if err != nil {
+			compression = err.Error()
+		}
+		printConfig(compression, se.settings)
+		return
+	}
+	if isTruthy(os.Getenv(EnvPlan)) {
+		se.printPlan()
+		return
+	}
+	if _, ok := se.opts["verify"]; ok || isTruthy(os.Getenv(EnvVerify)) {
+		se.selfTest()
+		return
+	}
+	if name, ok := se.opts["install-service"]; ok {
+		installService(name, se.args, se.settings)
+		return
+	}
+	if name, ok := se.opts["install-task"]; ok {
+		installTask(name, se.args)
+		return
+	}
+
+	if os.Getenv(EnvServer) == serverDaemon {
+		os.Exit(se.serve())
+	}
+	if se.useServer() {
+		if code, ok := se.runClient(); ok {
+			os.Exit(code)
+		}
+	}
+	if isService() {
+		os.Exit(runService(&se))
+	}
+	os.Exit(se.run())
+}
+
+// run extracts the payload, runs the startup command and cleans up, returning
+// the exit code of the command.
+func (se *selfExtractor) run() int {
+	dieHooks = append(dieHooks, func() { se.writeStatus(1) })
 	se.setupSignals()
+	se.checkExpiry()
+	se.checkRevocation()
+	se.checkDirOverride()
+	se.entry = se.selectEntry()
+	done := timePhase("prepare")
+	unlock := se.lockExtractDir()
 	se.prepareExtractDir()
+	done()
 	se.extract()
+	unlock()
+	if !se.tempDir && isTruthy(os.Getenv(EnvKeepTmp)) {
+		se.excludeFromTmpCleanup()
+	}
 	go se.startup()
 	exit := <-se.exitCode
+	se.waitOutputs()
+	if !se.extractOnly {
+		se.runPreCleanupHook(exit)
+	}
 	se.cleanup()
-	os.Exit(exit)
+	debug("timings:", timings.summary())
+	reportWarnings()
+	se.writeStatus(exit)
+	return exit
 }
 
-func (se *selfExtractor) setupSignals() {
+// graceTimeout returns how long to wait after receiving a signal before
+// exiting.
+func graceTimeout() time.Duration {
 	grace := 10 * time.Second
 	if graceStr := os.Getenv(EnvGraceTimeout); graceStr != "" {
 		graceFl, err := strconv.ParseFloat(graceStr, 32)
@@ -52,6 +191,11 @@ func (se *selfExtractor) setupSignals() {
 			grace = time.Duration(graceFl) * time.Second
 		}
 	}
+	return grace
+}
+
+func (se *selfExtractor) setupSignals() {
+	grace := graceTimeout()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGABRT, syscall.SIGQUIT)
@@ -60,45 +204,136 @@ func (se *selfExtractor) setupSignals() {
 		<-c
 		debug("got signal, waiting for grace timeout before exiting")
 		if grace != 0 {
-			time.Sleep(grace)
+			clock.Sleep(grace)
 		}
+		se.killChildren()
 		se.exitCode <- 2
 	}()
 }
 
 func (se *selfExtractor) getTarReader() *tar.Reader {
-	zRdr, err := zstd.NewReader(se.payload)
+	payload := se.payload
+	if p, ok := se.payload.(*filePayload); ok {
+		compression, _, err := detectCompression(p, se.blocks)
+		if err == nil && compression == "none" {
+			// reading the tar from the file directly lets the tar reader
+			// seek over the data of files, and know where it is
+			_, err = p.Seek(0, io.SeekStart)
+			if err != nil {
+				die("rewinding payload:", err)
+			}
+			debug("payload compression:", compression)
+			se.rawPayload = p
+			return tar.NewReader(p)
+		}
+		_, err = p.Seek(0, io.SeekStart)
+		if err != nil {
+			die("rewinding payload:", err)
+		}
+		if p.profile.readBlock > 0 {
+			payload = bufio.NewReaderSize(p, p.profile.readBlock)
+		}
+	}
+
+	zRdr, err := newDecompressor(payload, se.blocks)
 	if err != nil {
-		die("creating zstd reader:", err)
+		die("reading payload:", err)
+	}
+
+	return tar.NewReader(timingReader{zRdr, &se.decompressTime})
+}
+
+// lockExtractDir serializes the instances sharing an extraction dir, until
+// the returned function is called: the first one extracts the payload, and the
+// next ones find its key file and reuse the extracted files.
+func (se *selfExtractor) lockExtractDir() func() {
+	extractDir := os.Getenv(EnvDir)
+	if extractDir == "" {
+		return func() {}
 	}
 
-	return tar.NewReader(zRdr)
+	// the lock file is next to the extraction dir, which can be wiped
+	extractDir = filepath.Clean(extractDir)
+	err := os.MkdirAll(filepath.Dir(extractDir), 0755)
+	if err != nil {
+		die("creating parent of extraction directory:", err)
+	}
+	debug("locking extraction dir")
+	lock, err := lockPath(extractDir)
+	if err != nil {
+		die("locking extraction directory:", err)
+	}
+	dieHooks = append(dieHooks, lock.unlock)
+	return lock.unlock
 }
 
+// prepareExtractDir picks the extraction dir, and empties it when it holds
+// the files of another archive. The payload is verified before anything is
+// written or removed, unless it isn't going to be extracted.
 func (se *selfExtractor) prepareExtractDir() {
 	extractDir := os.Getenv(EnvDir)
 
 	if extractDir == "" {
-		var err error
-		se.extractDir, err = os.MkdirTemp("", "selfextract")
-		if err != nil {
-			die("creating temporary extraction directory:", err)
-		}
+		se.verifyPayload()
+		need, _ := payloadSize(se.blocks)
+		se.extractDir = makeTempExtractDir(need)
 		se.tempDir = true
 		return
 	}
 
 	se.extractDir = extractDir
+	se.merge = isTruthy(os.Getenv(EnvMerge))
 
-	stat, err := os.Stat(extractDir)
-	// if there's an error, we'll assume that it's because the directory
-	// doesn't exist, so we create it
-	if err != nil {
-		err = os.MkdirAll(extractDir, 0755)
+	state := se.extractDirState(extractDir)
+	if state != dirKeyMatches {
+		se.verifyPayload()
+	}
+	switch state {
+	case dirMissing:
+		err := os.MkdirAll(extractDir, 0755)
 		if err != nil {
 			die("creating extraction directory:", err)
 		}
-		return
+	case dirNoKey:
+		if se.merge {
+			debug("merging into extraction dir")
+			return
+		}
+		se.resolveConflict()
+	case dirKeyMatches:
+		debug("extraction dir has matching key")
+		se.skipExtract = true
+	case dirKeyMismatch:
+		if se.merge {
+			debug("key doesn't match, merging into extraction dir")
+			return
+		}
+		debug("key doesn't match, cleaning extraction dir")
+		err := cleanupDir(extractDir)
+		if err != nil {
+			die("cleaning extraction dir:", err)
+		}
+	}
+}
+
+// extractDirState is what a persistent extraction dir holds.
+type extractDirState int
+
+const (
+	dirMissing extractDirState = iota
+	dirEmpty
+	dirNoKey // not empty, without key file
+	dirKeyMatches
+	dirKeyMismatch
+)
+
+// extractDirState checks what the extraction dir holds, without changing it.
+func (se *selfExtractor) extractDirState(extractDir string) extractDirState {
+	stat, err := os.Stat(extractDir)
+	// if there's an error, we'll assume that it's because the directory
+	// doesn't exist, so it is to be created
+	if err != nil {
+		return dirMissing
 	}
 
 	if !stat.IsDir() {
@@ -113,70 +348,248 @@ func (se *selfExtractor) prepareExtractDir() {
 	// it contains. If it's neither, the extract dir path may have been set to
 	// an existing non-empty directory by error, so as a safeguard we abort.
 
-	entries, err := os.ReadDir(extractDir)
+	// the key file is looked for first, so that the runs reusing the
+	// extracted files don't list the directory
+	keyFile, err := os.Open(filepath.Join(extractDir, keyFileName))
+	if err == nil {
+		defer keyFile.Close()
+		keyData, err := io.ReadAll(keyFile)
+		if err != nil {
+			die("reading key file (extraction dir must be empty or contain a valid key file):", err)
+		}
+		if se.matchesKey(strings.TrimSpace(string(keyData))) {
+			return dirKeyMatches
+		}
+		return dirKeyMismatch
+	}
+	debug("opening key file:", err)
+
+	dir, err := os.Open(extractDir)
 	if err != nil {
 		die("listing extraction dir:", err)
 	}
-	if len(entries) == 0 {
-		return
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	if err == io.EOF {
+		return dirEmpty
 	}
-
-	keyFile, err := os.Open(filepath.Join(extractDir, keyFileName))
 	if err != nil {
-		die("opening key file (extraction dir must be empty or contain a valid key file):", err)
+		die("listing extraction dir:", err)
 	}
-	defer keyFile.Close()
+	return dirNoKey
+}
 
-	keyData, err := io.ReadAll(keyFile)
-	if err != nil {
-		die("reading key file (extraction dir must be empty or contain a valid key file):", err)
+// tempDirCandidates lists where temporary extraction dirs can be created, in
+// order of preference.
+func tempDirCandidates() []string {
+	candidates := []string{os.TempDir()}
+	if runtime.GOOS != "windows" {
+		candidates = append(candidates, "/var/tmp", "/tmp")
+	}
+	if dir, err := userCacheDir(); err == nil {
+		candidates = append(candidates, dir)
 	}
+	if exePath, err := executable(); err == nil {
+		candidates = append(candidates, filepath.Dir(exePath))
+	}
+	return candidates
+}
 
-	if hex.EncodeToString(se.key) == strings.TrimSpace(string(keyData)) {
-		debug("extraction dir has matching key")
-		se.skipExtract = true
-		return
+// makeTempExtractDir creates a temporary extraction dir in the first usable
+// candidate directory. Minimal containers may have no /tmp, or an unwritable
+// one, and /tmp is often a tmpfs too small for big payloads: candidates with
+// less than need bytes free are skipped, unless none has enough.
+func makeTempExtractDir(need uint64) string {
+	dir, enough, attempts := tryTempExtractDirs(need)
+	if dir == "" {
+		var rejected []string
+		for _, a := range attempts {
+			rejected = append(rejected, fmt.Sprintf("%s (%s)", a.Root, a.Error))
+		}
+		die(msg("no-temp-dir", "{dirs}", strings.Join(rejected, ", "), "{env}", EnvDir))
+	}
+	if !enough {
+		warn(fmt.Sprintf("no temporary dir has the %d bytes needed for extraction, using %s anyway", need, filepath.Dir(dir)))
 	}
+	return dir
+}
 
-	debug("key doesn't match, cleaning extraction dir")
-	err = cleanupDir(extractDir)
-	if err != nil {
-		die("cleaning extraction dir:", err)
+// tempDirAttempt is how a candidate for the temporary extraction dir fared.
+type tempDirAttempt struct {
+	Root      string  `json:"root"`
+	FreeBytes *uint64 `json:"free_bytes,omitempty"`
+	NoExec    bool    `json:"noexec,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Chosen    bool    `json:"chosen,omitempty"`
+}
+
+// tryTempExtractDirs creates a temporary extraction dir in the first
+// candidate with need bytes free, or else in the first usable one, and
+// returns it, whether it has enough space, and how each candidate tried
+// fared. It returns no dir if none is usable.
+func tryTempExtractDirs(need uint64) (string, bool, []tempDirAttempt) {
+	var attempts []tempDirAttempt
+	// first usable candidate, in case none has enough free space
+	var fallback string
+	fallbackAttempt := -1
+	seen := make(map[string]bool)
+	for _, root := range tempDirCandidates() {
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		attempt := tempDirAttempt{Root: root}
+
+		if cacheDir, _ := userCacheDir(); root == cacheDir {
+			// unlike the system dirs, it may not have been created yet
+			os.MkdirAll(root, 0700)
+		}
+		stat, err := os.Stat(root)
+		if err == nil && !stat.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err == nil {
+			var dir string
+			dir, err = os.MkdirTemp(root, "selfextract")
+			if err == nil {
+				free, ferr := freeSpace(dir)
+				if ferr == nil {
+					attempt.FreeBytes = &free
+				}
+				if ferr != nil || free >= need {
+					if fallback != "" {
+						os.Remove(fallback)
+					}
+					attempt.Chosen = true
+					return dir, true, append(attempts, attempt)
+				}
+				debug(fmt.Sprintf("not enough space in %s for temporary extraction dir: %d bytes free, %d needed", root, free, need))
+				attempt.Error = fmt.Sprintf("not enough space, %d bytes needed", need)
+				if fallback == "" {
+					fallback = dir
+					fallbackAttempt = len(attempts)
+				} else {
+					os.Remove(dir)
+				}
+				attempts = append(attempts, attempt)
+				continue
+			}
+		}
+		debug("cannot use", root, "for temporary extraction dir:", err)
+		attempt.Error = err.Error()
+		attempts = append(attempts, attempt)
+	}
+	if fallback != "" {
+		attempts[fallbackAttempt].Chosen = true
+	}
+	return fallback, false, attempts
+}
+
+// resolveConflict decides what to do with a non-empty extraction dir that has
+// no key file, either from the environment or by asking the user.
+func (se *selfExtractor) resolveConflict() {
+	action := os.Getenv(EnvOnConflict)
+	if action == "" && isTerminal(os.Stdin) && isTerminal(os.Stderr) {
+		action = prompt(msg("conflict-prompt", "{dir}", se.extractDir))
+		switch action {
+		case "w":
+			action = "wipe"
+		case "r":
+			action = "reuse"
+		case "a":
+			action = "abort"
+		}
+	}
+
+	switch action {
+	case "wipe":
+		debug("wiping extraction dir")
+		err := cleanupDir(se.extractDir)
+		if err != nil {
+			die("cleaning extraction dir:", err)
+		}
+	case "reuse":
+		debug("reusing extraction dir as is")
+		se.skipExtract = true
+	case "", "abort":
+		die(msg("conflict-abort", "{env}", EnvOnConflict))
+	default:
+		die("invalid value for", EnvOnConflict+":", action)
 	}
 }
 
-// cleanupDir removes the contents of a directory but not the directory itself
+// cleanupDir removes the contents of a directory but not the directory itself,
+// nor the running archive if it is inside
 func cleanupDir(dir string) error {
+	// the commands may have made it read-only
+	if info, err := os.Stat(dir); err == nil {
+		makeWritable(dir, info)
+	}
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return err
 	}
+	var cErr *cleanupError
 	for _, entry := range entries {
-		err := os.RemoveAll(filepath.Join(dir, entry.Name()))
-		if err != nil {
-			return err
+		path := filepath.Join(dir, entry.Name())
+		if isRunningArchive(path) {
+			debug("not removing the running archive", path)
+			continue
+		}
+		if entry.IsDir() && holdsRunningArchive(path) {
+			err = cleanupDir(path)
+		} else {
+			err = removeAll(path)
 		}
+		var eErr *cleanupError
+		if errors.As(err, &eErr) {
+			if cErr == nil {
+				cErr = eErr
+			} else {
+				cErr.paths = append(cErr.paths, eErr.paths...)
+			}
+		}
+	}
+	if cErr != nil {
+		return cErr
 	}
 	return nil
 }
 
+// createFile creates the file at path, or truncates it. A symlink at path,
+// e.g. extracted from an earlier entry of the same name, is replaced rather
+// than followed.
 func createFile(path string) (*os.File, error) {
 	dir := filepath.Dir(path)
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Create(path)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|openNoFollow, 0666)
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
-func cleanupAndDie(dir string, v ...interface{}) {
-	err := cleanupDir(dir)
+// cleanupAndDie erases the partially extracted files, unless they were merged
+// with pre-existing files, then dies.
+func (se *selfExtractor) cleanupAndDie(v ...interface{}) {
+	if se.writes != nil {
+		se.writes.wait()
+	}
+	if se.merge {
+		die(v...)
+	}
+	err := cleanupDir(se.extractDir)
 	if err != nil {
-		die(append([]interface{}{"got error:", err, "while cleaning up after:"}, v...))
+		die(append([]interface{}{"got error:", err, "while cleaning up after:"}, v...)...)
 	}
 	die(v...)
 }
@@ -188,8 +601,44 @@ func (se *selfExtractor) extract() {
 		debug("skipping extraction")
 		return
 	}
+	readAhead(se.payload)
+
+	start := time.Now()
+	defer func() {
+		total := time.Since(start)
+		timings.add("decompress", se.decompressTime)
+		timings.add("extract", total-se.decompressTime)
+	}()
+
+	se.parseOwnerMaps()
+	se.parseSpecialBitsPolicy()
+	se.noMtime = isTruthy(os.Getenv(EnvNoMtime))
+	se.parseUnsafePathsPolicy()
+	dirsCreated := se.precreateDirs()
+
+	caps := probeFS(se.extractDir)
+	if !caps.execBits {
+		warn("extraction dir doesn't support file modes, they will not be preserved")
+	}
+
+	// on filesystems without symlinks, the targets are copied once all the
+	// files are extracted
+	type link struct{ name, target string }
+	var links []link
+	// the symlinks created, by name in the extraction dir, whose targets
+	// are checked again once all of them exist
+	var symlinks []link
+	// extracting entries in a directory changes its modification time, so
+	// it is restored once the directory is complete
+	type dirTime struct {
+		name  string
+		mtime time.Time
+	}
+	var dirTimes []dirTime
+	var manifest []*manifestEntry
 
 	tarRdr := se.getTarReader()
+	se.writes = newWritePool(writeWorkers)
 
 	for {
 		hdr, err := tarRdr.Next()
@@ -204,26 +653,111 @@ func (se *selfExtractor) extract() {
 		if name == "." {
 			continue
 		}
+		err = se.checkEntry(name, hdr)
+		if err != nil {
+			se.cleanupAndDie("unsafe entry in archive,", err)
+		}
+		if longestName(name) > caps.nameMax {
+			se.cleanupAndDie("extraction dir doesn't support file names longer than", caps.nameMax, "bytes, set", EnvDir, "to another location:", name)
+		}
 		pathName := filepath.Join(se.extractDir, name)
+		if isRunningArchive(pathName) {
+			se.cleanupAndDie("extracting", name, "would overwrite the running archive, set", EnvDir, "to another location")
+		}
+		if err := se.writes.err(); err != nil {
+			se.cleanupAndDie(err)
+		}
+		se.writes.claim(pathName)
+		// checking the symlinks of the archive doesn't prevent chains of
+		// them from escaping, nor the existing files when merging
+		if !se.allowUnsafePaths {
+			err = checkParents(se.extractDir, name)
+			if err == nil && hdr.Typeflag == tar.TypeLink {
+				err = checkParents(se.extractDir, filepath.Clean(hdr.Linkname))
+				if err == nil {
+					depth := 0
+					_, err = resolveInDir(se.extractDir, ".", filepath.Clean(hdr.Linkname), &depth)
+					if err != nil {
+						err = fmt.Errorf("hard link %s points outside of the extraction dir: %s: %w", hdr.Name, hdr.Linkname, err)
+					}
+				}
+			}
+			if err == nil && hdr.Typeflag == tar.TypeSymlink {
+				err = checkLinkTarget(se.extractDir, name, hdr.Linkname)
+			}
+			if err != nil {
+				se.cleanupAndDie("unsafe entry in archive,", err)
+			}
+		}
+		if se.merge {
+			se.clearPath(pathName, hdr.Typeflag)
+		}
+		entry := &manifestEntry{
+			Path: filepath.ToSlash(name),
+			Mode: os.FileMode(hdr.Mode).Perm(),
+		}
 		switch hdr.Typeflag {
-		case tar.TypeReg:
-			debug("extracting file", name, "of size", hdr.Size)
+		case tar.TypeReg, tar.TypeGNUSparse:
+			var contents io.Reader = tarRdr
+			size := hdr.Size
+			encrypted := isEncryptedEntry(hdr)
+			if encrypted {
+				contents, size, err = decryptEntry(tarRdr, hdr)
+				if err != nil {
+					se.cleanupAndDie(err)
+				}
+			}
+			debug("extracting file", name, "of size", size)
+			entry.Type, entry.Size = "file", size
+			mode := se.fileMode(name, hdr)
+			if size <= pooledFileMax && !isSparse(hdr) && (se.rawPayload == nil || encrypted) {
+				data := make([]byte, size)
+				_, err := io.ReadFull(contents, data)
+				if err != nil {
+					se.cleanupAndDie("reading embedded tar:", err)
+				}
+				se.writes.submit(pathName, func() error {
+					return se.writeFile(pathName, data, mode, hdr, caps.execBits, entry)
+				})
+				manifest = append(manifest, entry)
+				continue
+			}
+
 			f, err := createFile(pathName)
 			if err != nil {
-				cleanupAndDie(se.extractDir, "creating file:", err)
+				se.cleanupAndDie("creating file:", err)
 			}
 
-			_, err = io.Copy(f, tarRdr)
+			h := sha256.New()
+			if isSparse(hdr) {
+				err = writeSparse(f, io.TeeReader(tarRdr, h), hdr.Size)
+			} else if se.rawPayload != nil && !encrypted {
+				// the tar reader seeks over the data, which isn't read
+				h = nil
+				err = se.copyRaw(f, hdr.Size)
+			} else {
+				var n int64
+				n, err = io.Copy(io.MultiWriter(f, h), contents)
+				if err == nil && n != size {
+					err = fmt.Errorf("size of %s is %d instead of %d", name, n, size)
+				}
+			}
 			if err != nil {
-				cleanupAndDie(se.extractDir, "writing file:", err)
+				se.cleanupAndDie("writing file:", err)
+			}
+			if h != nil {
+				entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+			} else {
+				// archives made by older versions don't record it
+				entry.SHA256 = hdr.PAXRecords[digestRecord]
 			}
 
-			err = f.Chmod(os.FileMode(hdr.Mode))
+			err = se.finishFile(f, mode, hdr, caps.execBits)
 			if err != nil {
-				cleanupAndDie(se.extractDir, "setting mode of file:", err)
+				se.cleanupAndDie(err)
 			}
-
-			f.Close()
+			manifest = append(manifest, entry)
+			continue
 		case tar.TypeDir:
 			debug("creating directory", name)
 			// We choose to disregard directory permissions and use a default
@@ -231,23 +765,223 @@ func (se *selfExtractor) extract() {
 			// complex to handle, both when extracting and also when cleaning
 			// up the directory.
 			err := os.Mkdir(pathName, 0755)
-			if err != nil {
-				cleanupAndDie(se.extractDir, "creating directory", err)
+			if err != nil && !((se.merge || dirsCreated) && os.IsExist(err)) {
+				se.cleanupAndDie("creating directory", err)
 			}
+			entry.Type = "dir"
+			dirTimes = append(dirTimes, dirTime{pathName, hdr.ModTime})
 		case tar.TypeSymlink:
+			entry.Type, entry.Target = "symlink", hdr.Linkname
+			if !caps.symlinks {
+				links = append(links, link{pathName, hdr.Linkname})
+				manifest = append(manifest, entry)
+				continue
+			}
 			debug("creating symlink", name)
-			err := os.Symlink(hdr.Linkname, pathName)
+			// the files being written were checked without it
+			err := se.writes.wait()
 			if err != nil {
-				cleanupAndDie(se.extractDir, "creating symlink", err)
+				se.cleanupAndDie(err)
 			}
+			err = os.Symlink(hdr.Linkname, pathName)
+			if err != nil {
+				se.cleanupAndDie("creating symlink", err)
+			}
+			symlinks = append(symlinks, link{name, hdr.Linkname})
+		case tar.TypeLink:
+			target := filepath.Clean(hdr.Linkname)
+			debug("creating hard link", name, "to", target)
+			targetPath := filepath.Join(se.extractDir, target)
+			se.writes.claim(targetPath)
+			err := os.Link(targetPath, pathName)
+			if err != nil {
+				// filesystems without hard links get a copy instead
+				debug("could not create hard link, copying", target, "to", name+":", err)
+				err = copyPath(targetPath, pathName)
+				if err != nil {
+					se.cleanupAndDie("creating hard link", err)
+				}
+			}
+			entry.Type, entry.Target = "hardlink", filepath.ToSlash(target)
 		default:
-			cleanupAndDie(se.extractDir, "unsupported file type in tar", hdr.Typeflag)
+			se.cleanupAndDie("unsupported file type in tar", hdr.Typeflag)
+		}
+		if err := se.chownEntry(pathName, hdr); err != nil {
+			se.cleanupAndDie(err)
 		}
+		se.restoreXattrs(pathName, hdr)
+		manifest = append(manifest, entry)
 	}
+	if err := se.writes.close(); err != nil {
+		se.cleanupAndDie(err)
+	}
+	se.writes = nil
 
+	// a target checked before the symlinks it goes through existed may
+	// resolve outside of the extraction dir now
+	if !se.allowUnsafePaths {
+		for _, l := range symlinks {
+			err := checkLinkTarget(se.extractDir, l.name, l.target)
+			if err != nil {
+				se.cleanupAndDie("unsafe entry in archive,", err)
+			}
+		}
+	}
+
+	for _, l := range links {
+		target := l.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(l.name), target)
+		}
+		debug("copying", target, "to", l.name, "in place of a symlink")
+		err := copyPath(target, l.name)
+		if err != nil {
+			warn("extraction dir doesn't support symlinks, could not copy target of", l.name+":", err)
+		}
+	}
+
+	// children come after their parent in the archive
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		se.restoreMtime(dirTimes[i].name, dirTimes[i].mtime)
+	}
+
+	entries := make([]manifestEntry, len(manifest))
+	for i, entry := range manifest {
+		entries[i] = *entry
+	}
+	se.writeManifest(entries)
 	se.createKeyFile()
 }
 
+// writeFile writes an extracted file whose contents were read in memory,
+// with the mode, modification time, owner and extended attributes it has in
+// the archive, and records its digest in its manifest entry. It is run by the
+// write pool.
+func (se *selfExtractor) writeFile(path string, data []byte, mode os.FileMode, hdr *tar.Header, execBits bool, entry *manifestEntry) error {
+	f, err := createFile(path)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing file: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	entry.SHA256 = hex.EncodeToString(sum[:])
+	return se.finishFile(f, mode, hdr, execBits)
+}
+
+// finishFile gives an extracted file its owner, then its mode, which changing
+// the owner would strip of the setuid and setgid bits, then closes it and
+// restores its modification time and extended attributes.
+func (se *selfExtractor) finishFile(f *os.File, mode os.FileMode, hdr *tar.Header, execBits bool) error {
+	path := f.Name()
+	err := se.chownEntry(path, hdr)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Chmod(mode)
+	if err != nil && execBits {
+		f.Close()
+		return fmt.Errorf("setting mode of file: %w", err)
+	}
+	f.Close()
+	se.restoreMtime(path, hdr.ModTime)
+	se.restoreXattrs(path, hdr)
+	return nil
+}
+
+// restoreMtime gives an extracted entry the modification time it has in the
+// archive. Archives made before it was recorded have none, so the time of the
+// extraction is kept.
+func (se *selfExtractor) restoreMtime(path string, mtime time.Time) {
+	if se.noMtime || mtime.IsZero() || mtime.Unix() == 0 {
+		return
+	}
+	err := os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		warn("could not set modification time of", path+":", err)
+	}
+}
+
+// parseOwnerMaps reads the mappings of the owners of the files in the archive
+// to the ones of the extracted files, and whether the others keep their
+// recorded owners. They only apply when running as root.
+func (se *selfExtractor) parseOwnerMaps() {
+	if se.settings.PreserveOwner || isTruthy(os.Getenv(EnvPreserveOwner)) {
+		if os.Geteuid() == 0 {
+			se.preserveOwner = true
+		} else if !se.settings.PreserveOwner {
+			warn("not running as root, ignoring", EnvPreserveOwner)
+		}
+	}
+
+	ownerMap, groupMap := os.Getenv(EnvOwnerMap), os.Getenv(EnvGroupMap)
+	if ownerMap == "" && groupMap == "" {
+		return
+	}
+	if os.Geteuid() != 0 {
+		warn("not running as root, ignoring", EnvOwnerMap, "and", EnvGroupMap)
+		return
+	}
+	if ownerMap != "" {
+		err := se.ownerMap.Set(ownerMap)
+		if err != nil {
+			se.cleanupAndDie(EnvOwnerMap+":", err)
+		}
+	}
+	if groupMap != "" {
+		err := se.groupMap.Set(groupMap)
+		if err != nil {
+			se.cleanupAndDie(EnvGroupMap+":", err)
+		}
+	}
+}
+
+// chownEntry gives an extracted entry the owner and group its ones in the
+// archive are mapped to, if any, or the recorded ones when preserving owners.
+func (se *selfExtractor) chownEntry(path string, hdr *tar.Header) error {
+	uid, uok := se.ownerMap.lookup(hdr.Uid)
+	gid, gok := se.groupMap.lookup(hdr.Gid)
+	if se.preserveOwner {
+		uok, gok = true, true
+	}
+	if !uok && !gok {
+		return nil
+	}
+	if !uok {
+		uid = -1
+	}
+	if !gok {
+		gid = -1
+	}
+	err := os.Lchown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("changing owner of %s: %w", path, err)
+	}
+	return nil
+}
+
+// clearPath removes what is in the way of extracting an entry of the given
+// type at path. Existing directories are kept, so that their contents get
+// merged with the archive's.
+func (se *selfExtractor) clearPath(path string, typ byte) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() && typ == tar.TypeDir {
+		return
+	}
+	debug("replacing", path)
+	err = removeAll(path)
+	if err != nil {
+		se.cleanupAndDie("replacing existing file:", err)
+	}
+}
+
 func (se *selfExtractor) createKeyFile() {
 	f, err := os.Create(filepath.Join(se.extractDir, keyFileName))
 	if err != nil {
@@ -264,108 +998,375 @@ func (se *selfExtractor) createKeyFile() {
 }
 
 func (se *selfExtractor) startup() {
-	if isTruthy(os.Getenv(EnvExtractOnly)) {
+	if se.extractOnly {
 		debug("extract only mode, skipping startup")
+		se.printExtractDir()
 		se.exitCode <- 0
 		return
 	}
 
-  cmdline := os.Getenv(EnvCmdline)
-	startup := os.Getenv(EnvStartup)
+	cmdline := payloadFileName(EnvCmdline, "selfextract_cmdline")
+	startup := payloadFileName(EnvStartup, "selfextract_startup")
 
-  if cmdline == "" {
-    cmdline = "selfextract_cmdline"
-  }
+	os.Setenv(EnvDir, se.extractDir)
+	os.Setenv(EnvFirstRun, strconv.FormatBool(!se.skipExtract))
+	se.countRun()
 
-	if startup == "" {
-		startup = "selfextract_startup"
+	if !se.skipExtract {
+		code := se.runExtractHooks()
+		if code != 0 {
+			se.exitCode <- code
+			return
+		}
+	}
+	if code := se.runHook(se.hookPath("pre_run"), "pre_run hook"); code != 0 {
+		se.exitCode <- code
+		return
 	}
 
-	os.Setenv(EnvDir, se.extractDir)
+	if cmd, ok := se.commandOverride(); ok {
+		debug("using command override")
+		se.runCmdlineString(cmd, "command override")
+		return
+	}
+	if se.entry != "" {
+		debug("using entrypoint", se.entry)
+		se.runCmdlineString(se.settings.Entries[se.entry], "entrypoint "+se.entry)
+		return
+	}
+
+	composePath := filepath.Join(se.extractDir, composeFileName)
+	_, err := os.Stat(composePath)
+	if err == nil {
+		se.runCompose(composePath)
+		return
+	}
 
 	debug("try using cmdline file", cmdline)
 	cmdlinePath := filepath.Join(se.extractDir, cmdline)
-  _, err := os.Stat(cmdlinePath)
-  if err == nil {
-    se.runCmdline(cmdlinePath)
-    return
-  }
+	_, err = os.Stat(cmdlinePath)
+	if err == nil {
+		se.runCmdline(cmdlinePath)
+		return
+	}
+
+	if se.settings.Cmd != "" {
+		debug("using command of the archive")
+		se.runCmdlineString(se.settings.Cmd, "command of the archive")
+		return
+	}
 
 	debug("try using startup script", startup)
 	startupPath := filepath.Join(se.extractDir, startup)
-  _, err = os.Stat(startupPath)
-  if err == nil {
-    se.runStartup(startupPath)
-    return
-  }
+	_, err = os.Stat(startupPath)
+	if err == nil {
+		se.runStartup(startupPath)
+		return
+	}
+
+	debug("nothing to run")
+	se.exitCode <- 0
+}
+
+// payloadFileName returns the name of a file of the payload the stub looks
+// for, which is def unless set with the variable env.
+func payloadFileName(env, def string) string {
+	name := os.Getenv(env)
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+// firstRunHookName is a script run after each fresh extraction, before the
+// startup command, for one-time setup that only has to be done again when the
+// contents of the archive change.
+const firstRunHookName = "selfextract_first_run"
+
+// The hooks of hooksDirName are scripts run at points of the life of the
+// archive: post_extract after each fresh extraction, like the first run hook,
+// pre_run before the command at each run, and pre_cleanup once the command
+// exited, with its exit code in SELFEXTRACT_EXIT_CODE.
+const hooksDirName = "selfextract_hooks"
+
+func (se *selfExtractor) hookPath(name string) string {
+	return filepath.Join(se.extractDir, hooksDirName, name)
+}
+
+// runExtractHooks runs the hooks of fresh extractions, and returns the exit
+// code of the first one failing.
+func (se *selfExtractor) runExtractHooks() int {
+	for _, hook := range []struct{ path, what string }{
+		{filepath.Join(se.extractDir, firstRunHookName), "first run hook"},
+		{se.hookPath("post_extract"), "post_extract hook"},
+	} {
+		code := se.runHook(hook.path, hook.what)
+		if code != 0 {
+			if !se.tempDir {
+				// invalidating the key makes the next run extract
+				// again, and so run the hooks again
+				os.WriteFile(filepath.Join(se.extractDir, keyFileName), nil, 0644)
+			}
+			return code
+		}
+	}
+	return 0
+}
+
+// runPreCleanupHook runs the pre_cleanup hook with the exit code of the
+// archive, which its failures don't change.
+func (se *selfExtractor) runPreCleanupHook(exit int) {
+	os.Setenv(EnvExitCode, strconv.Itoa(exit))
+	code := se.runHook(se.hookPath("pre_cleanup"), "pre_cleanup hook")
+	if code != 0 {
+		warn("pre_cleanup hook failed with exit code", code)
+	}
+}
+
+// runHook runs the hook script at path, if the archive has it, and returns
+// its exit code.
+func (se *selfExtractor) runHook(path, what string) int {
+	_, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	debug("running", what)
+	defer timePhase(what)()
+	cmd := exec.Command(path)
+	code := 1
+	err = se.startCommand(cmd)
+	if err == nil {
+		code = se.waitCommand(cmd, what)
+	} else {
+		debug(what, "failed to start:", err)
+	}
+	return code
 }
 
 func (se *selfExtractor) runStartup(path string) {
-  cmd := exec.Command(path, os.Args[1:]...)
-  cmd.Stdin = os.Stdin
-  cmd.Stderr = os.Stderr
-  cmd.Stdout = os.Stdout
-  err := cmd.Run()
-  if err != nil {
-  	debug("startup script ended with error:", err)
-  	var ex *exec.ExitError
-  	if errors.As(err, &ex) {
-  		se.exitCode <- ex.ExitCode()
-  	} else {
-  		se.exitCode <- 1
-  	}
-  	return
-  }
-  se.exitCode <- 0
+	cmd := exec.Command(path, se.args...)
+	se.runCommand(cmd, "startup script")
 }
 
 func (se *selfExtractor) runCmdline(path string) {
-  cmdfile,err := os.Open(path)
-  if err != nil {
-    debug("failed to open cmdfile with error: ", err)
-    se.exitCode <- 1
-    return
-  }
-
-  cmdbytes,err := io.ReadAll(cmdfile)
-  if err != nil {
-    debug("failed to read cmdfile with error: ", err)
-    se.exitCode <- 1
-    return
-  }
-
-  defer cmdfile.Close()
-  cmdline := strings.TrimSpace(string(cmdbytes[:]))
-  cmdline = strings.ReplaceAll(cmdline, "__EXTRACT_DIR__", se.extractDir)
-  args, err := shlex.Split(cmdline)
-  if err != nil {
-    debug("failed to parse cmdline arguments", err)
-    se.exitCode <- 1
-    return
-  }
-
-  args = append(args, os.Args[1:]...)
-  cmd := exec.Command(args[0], args[1:]...)
-  cmd.Stdin = os.Stdin
-  cmd.Stderr = os.Stderr
-  cmd.Stdout = os.Stdout
-  err = cmd.Run()
-  if err != nil {
-  	debug("cmdline ended with error:", err)
-  	var ex *exec.ExitError
-  	if errors.As(err, &ex) {
-  		se.exitCode <- ex.ExitCode()
-  	} else {
-  		se.exitCode <- 1
-  	}
-  	return
-  }
-  se.exitCode <- 0
+	cmdfile, err := os.Open(path)
+	if err != nil {
+		debug("failed to open cmdfile with error: ", err)
+		se.exitCode <- 1
+		return
+	}
+
+	cmdbytes, err := io.ReadAll(cmdfile)
+	if err != nil {
+		debug("failed to read cmdfile with error: ", err)
+		se.exitCode <- 1
+		return
+	}
+
+	defer cmdfile.Close()
+	se.runCmdlineString(string(cmdbytes[:]), "cmdline")
+}
+
+// runCmdlineString runs a command line, in which __EXTRACT_DIR__ is replaced
+// by the extraction dir, with the arguments of the archive appended.
+func (se *selfExtractor) runCmdlineString(cmdline, what string) {
+	args, err := se.splitCmdline(cmdline)
+	if err != nil {
+		debug("failed to parse", what, "arguments", err)
+		se.exitCode <- 1
+		return
+	}
+	if len(args) == 0 {
+		debug(what, "is empty")
+		se.exitCode <- 1
+		return
+	}
+
+	args = append(args, se.args...)
+	cmd := exec.Command(args[0], args[1:]...)
+	se.runCommand(cmd, what)
+}
+
+// commandOverride returns the command line given with --selfextract-cmd or
+// SELFEXTRACT_CMD to run instead of the one of the archive, e.g. a debug shell
+// it bundles.
+func (se *selfExtractor) commandOverride() (string, bool) {
+	if cmd, ok := se.opts["cmd"]; ok {
+		return cmd, true
+	}
+	cmd := os.Getenv(EnvCmd)
+	return cmd, cmd != ""
+}
+
+// splitCmdline splits a command line into arguments, and then replaces
+// __EXTRACT_DIR__ in them, so that extraction dirs with spaces or quotes stay
+// in their arguments.
+func (se *selfExtractor) splitCmdline(cmdline string) ([]string, error) {
+	// arguments are passed to the system as C strings, which would be cut
+	if strings.ContainsRune(cmdline, 0) {
+		return nil, errors.New("NUL character in command line")
+	}
+	args, err := shlex.Split(strings.TrimSpace(cmdline))
+	if err != nil {
+		return nil, err
+	}
+	for i, arg := range args {
+		args[i] = strings.ReplaceAll(arg, "__EXTRACT_DIR__", se.extractDir)
+	}
+	return args, nil
+}
+
+// runCommand runs the payload command attached to the standard streams of the
+// stub, and reports its exit code.
+func (se *selfExtractor) runCommand(cmd *exec.Cmd, what string) {
+	if se.execMode() {
+		se.execCommand(cmd, what)
+		se.exitCode <- 1
+		return
+	}
+	done := timePhase("run")
+	err := se.startCommand(cmd)
+	if err != nil {
+		if errors.Is(err, syscall.E2BIG) {
+			warn(what, "failed to start, its", len(cmd.Args), "arguments are too long for the system:", err)
+		} else {
+			debug(what, "failed to start:", err)
+		}
+		se.exitCode <- 1
+		return
+	}
+	exit := se.waitCommand(cmd, what)
+	done()
+	se.exitCode <- exit
+}
+
+// startCommand starts a payload command attached to the standard streams of
+// the stub, or to log files.
+func (se *selfExtractor) startCommand(cmd *exec.Cmd) error {
+	stdout, stderr, err := se.childOutputs()
+	if err != nil {
+		warn("opening log files:", err)
+		return err
+	}
+	cmd.Stdin = os.Stdin
+	if cmd.Env == nil {
+		cmd.Env = se.childEnv()
+	}
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	se.recordAudit(cmd.Args)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	se.childMu.Lock()
+	se.children = append(se.children, cmd.Process)
+	se.childMu.Unlock()
+	se.running.Add(1)
+	return nil
+}
+
+// waitCommand waits for a started command and returns its exit code.
+func (se *selfExtractor) waitCommand(cmd *exec.Cmd, what string) int {
+	// waiting also copies the rest of the output written to pipes
+	err := cmd.Wait()
+	se.running.Done()
+	return commandExit(err, what)
+}
+
+// commandExit returns the exit code of a command that ended with err, which
+// is 128 plus the number of the signal that killed it, if any, like shells
+// do, so that e.g. the OOM killer is told apart from failures.
+func commandExit(err error, what string) int {
+	if err != nil {
+		debug(what, "ended with error:", err)
+		var ex *exec.ExitError
+		if errors.As(err, &ex) {
+			if sig, ok := killingSignal(ex.ProcessState); ok {
+				warn(what, "was killed by signal", int(sig), "("+sig.String()+")")
+				return 128 + int(sig)
+			}
+			return ex.ExitCode()
+		}
+		return 1
+	}
+	return 0
+}
+
+// stopChildren asks the payload commands to stop, and kills them if they're
+// still running after the grace timeout.
+func (se *selfExtractor) stopChildren() {
+	se.childMu.Lock()
+	children := append([]*os.Process(nil), se.children...)
+	se.childMu.Unlock()
+	for _, p := range children {
+		err := p.Signal(os.Interrupt)
+		if err != nil {
+			// interrupting isn't supported on Windows, or the process is
+			// already done
+			p.Kill()
+			continue
+		}
+		p := p
+		clock.AfterFunc(graceTimeout(), func() { p.Kill() })
+	}
+}
+
+// killChildren kills the payload commands still running.
+func (se *selfExtractor) killChildren() {
+	se.childMu.Lock()
+	defer se.childMu.Unlock()
+	for _, p := range se.children {
+		p.Kill()
+	}
+}
+
+// outputDrainTimeout bounds the wait for the output of the commands, which
+// never ends when they leave processes behind that hold it open.
+const outputDrainTimeout = 5 * time.Second
+
+// waitOutputs waits for the commands to be reaped, so that the last lines of
+// their output reach the log files before the stub exits and removes the
+// extraction dir they may be in.
+func (se *selfExtractor) waitOutputs() {
+	done := make(chan struct{})
+	go func() {
+		se.running.Wait()
+		close(done)
+	}()
+	timeout := make(chan struct{})
+	clock.AfterFunc(outputDrainTimeout, func() { close(timeout) })
+	select {
+	case <-done:
+	case <-timeout:
+		warn("output of the commands still open after " + outputDrainTimeout.String() + ", exiting without the rest of it")
+	}
+}
+
+// printExtractDir tells scripts using the extract only mode where the files
+// are. With --selfextract-porcelain, it prints stable "key value" lines.
+func (se *selfExtractor) printExtractDir() {
+	if _, ok := se.opts["porcelain"]; !ok {
+		fmt.Println(se.extractDir)
+		return
+	}
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	fmt.Printf("dir %s\n", se.extractDir)
+	fmt.Printf("extracted %s\n", yesNo[!se.skipExtract])
+	fmt.Printf("temporary %s\n", yesNo[se.tempDir])
+	fmt.Printf("key %s\n", hex.EncodeToString(se.key))
 }
 
 func (se *selfExtractor) cleanup() {
-	if se.tempDir {
+	// in extract only mode, the extracted files are meant to be used after
+	// the stub exits
+	if se.tempDir && !se.extractOnly {
 		debug("removing extraction dir")
-		os.RemoveAll(se.extractDir)
+		defer timePhase("cleanup")()
+		err := removeAll(se.extractDir)
+		if err != nil {
+			warn("removing extraction dir:", err)
+			se.addError("removing extraction dir:", err)
+		}
 	}
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The files matching -encrypt-files are archived encrypted within a payload
+// that isn't, so that their names and the other files stay readable by the
+// tools scanning archives. Their contents are encrypted like whole payloads
+// are, and their header has an encryptedRecord PAX record holding the size of
+// the decrypted contents.
+const encryptedRecord = "SELFEXTRACT.encrypted"
+
+// isEncryptedEntry reports whether the contents of an entry are encrypted.
+func isEncryptedEntry(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[encryptedRecord]
+	return ok
+}
+
+// decryptEntry returns the decrypted contents of an encrypted entry read from
+// r, and their size. The passphrase is the one of encrypted payloads.
+func decryptEntry(r io.Reader, hdr *tar.Header) (io.Reader, int64, error) {
+	size, err := strconv.ParseInt(hdr.PAXRecords[encryptedRecord], 10, 64)
+	if err != nil || size < 0 {
+		return nil, 0, fmt.Errorf("invalid size of encrypted file %s: %q", hdr.Name, hdr.PAXRecords[encryptedRecord])
+	}
+	passphrase, err := readPassphrase(false)
+	if err != nil {
+		return nil, 0, err
+	}
+	dr, err := newDecryptReader(r, passphrase)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decrypting %s: %w", hdr.Name, err)
+	}
+	return dr, size, nil
+}
@@ -0,0 +1,42 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// readFileList reads the paths of a list of files to archive given with -T,
+// from stdin if name is "-". Like with tar -T, the paths are one per line,
+// or separated by NUL bytes when the list has some, as written by find
+// -print0, for paths with newlines.
+func readFileList(name string) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, p := range strings.Split(string(data), sep) {
+		if sep == "\n" {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
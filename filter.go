@@ -0,0 +1,174 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// contentFilter transforms the contents of the files matching a glob pattern
+// while they're archived:
+//   - strip runs strip(1) on ELF executables and libraries
+//   - crlf converts CRLF line endings to LF
+//   - cmd:COMMAND runs COMMAND with sh, with the path of a copy of the file to
+//     modify in place as $1 (e.g. to strip timestamps from nested archives)
+type contentFilter struct {
+	pattern string
+	name    string
+	command string
+}
+
+func (f contentFilter) String() string {
+	if f.name == "cmd" {
+		return f.pattern + "=cmd:" + f.command
+	}
+	return f.pattern + "=" + f.name
+}
+
+// filterList is a repeatable flag of GLOB=FILTER values.
+type filterList []contentFilter
+
+func (l *filterList) String() string {
+	var s []string
+	for _, f := range *l {
+		s = append(s, f.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *filterList) Set(s string) error {
+	pattern, filter, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("filter must be GLOB=FILTER: %q", s)
+	}
+	f := contentFilter{pattern: pattern, name: filter}
+	switch {
+	case filter == "strip", filter == "crlf":
+	case strings.HasPrefix(filter, "cmd:"):
+		f.name, f.command = "cmd", strings.TrimPrefix(filter, "cmd:")
+	default:
+		return fmt.Errorf("unknown filter: %q", filter)
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+// matching returns the filters applying to a path.
+func (l filterList) matching(name string) []contentFilter {
+	var filters []contentFilter
+	for _, f := range l {
+		if matchAny(name, []string{f.pattern}) {
+			filters = append(filters, f)
+		}
+	}
+	return filters
+}
+
+// applyFilters filters a copy of a file, and returns the path of the copy. The
+// copy must be removed by the caller.
+func applyFilters(path string, filters []contentFilter) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp("", "selfextract-filter")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	for _, f := range filters {
+		if err != nil {
+			break
+		}
+		debug("applying filter", f, "to", path)
+		switch f.name {
+		case "strip":
+			err = stripELF(tmp)
+		case "crlf":
+			err = convertCRLF(tmp)
+		case "cmd":
+			cmd := exec.Command("sh", "-c", f.command, "selfextract-filter", tmp)
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+		}
+		if err != nil {
+			err = fmt.Errorf("filter %s: %w", f, err)
+		}
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func stripELF(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(f, magic)
+	f.Close()
+	if err != nil || string(magic) != "\x7fELF" {
+		return nil
+	}
+	cmd := exec.Command("strip", path)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func convertCRLF(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), 0600)
+}
+
+// encryptFile encrypts a copy of a file with passphrase, and returns the path
+// of the copy. The copy must be removed by the caller.
+func encryptFile(path string, passphrase []byte) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp("", "selfextract-encrypt")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	encWrt, err := newEncryptWriter(out, passphrase)
+	if err == nil {
+		_, err = io.Copy(encWrt, in)
+	}
+	if err == nil {
+		err = encWrt.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const probePrefix = ".selfextract-probe"
+
+// shortNameMax is the longest file name we expect any filesystem to support,
+// and longNameMax the longest most of them support.
+const (
+	shortNameMax = 12 // 8.3 names
+	longNameMax  = 255
+)
+
+// fsCaps describes the features supported by the filesystem of a directory.
+// Filesystems such as FAT, NTFS mounted through some drivers, or 9p shares
+// lack some of them.
+type fsCaps struct {
+	symlinks bool
+	execBits bool
+	nameMax  int // longest file name, in bytes
+}
+
+// probeFS checks which features the filesystem of dir supports, by creating
+// (and removing) temporary files in it.
+func probeFS(dir string) fsCaps {
+	var caps fsCaps
+
+	f, err := os.CreateTemp(dir, probePrefix)
+	if err != nil {
+		die("probing extraction dir:", err)
+	}
+	probe := f.Name()
+	f.Close()
+	defer os.Remove(probe)
+
+	err = os.Chmod(probe, 0755)
+	if err == nil {
+		info, err := os.Stat(probe)
+		caps.execBits = err == nil && info.Mode().Perm() == 0755
+	}
+
+	link := probe + "-link"
+	err = os.Symlink(filepath.Base(probe), link)
+	if err == nil {
+		caps.symlinks = true
+		os.Remove(link)
+	}
+
+	caps.nameMax = probeNameMax(dir)
+
+	debug("extraction dir supports symlinks:", caps.symlinks, "exec bits:", caps.execBits, "names up to:", caps.nameMax)
+	return caps
+}
+
+// probeNameMax returns the length of the longest file name the filesystem of
+// dir accepts, searching between the short and the long names when the long
+// ones fail, e.g. on eCryptfs and its 143 bytes.
+func probeNameMax(dir string) int {
+	fits := func(n int) bool {
+		name := filepath.Join(dir, (probePrefix + strings.Repeat("x", n))[:n])
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			// a file already having the name tells it fits
+			return os.IsExist(err)
+		}
+		f.Close()
+		os.Remove(name)
+		return true
+	}
+	if fits(longNameMax) {
+		return longNameMax
+	}
+	lo, hi := shortNameMax, longNameMax-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// longestName returns the length of the longest element of a path.
+func longestName(name string) int {
+	longest := 0
+	for _, elem := range strings.Split(name, string(filepath.Separator)) {
+		if len(elem) > longest {
+			longest = len(elem)
+		}
+	}
+	return longest
+}
+
+// copyPath copies a file or a directory tree, following symlinks. It is used
+// in place of symlinks on filesystems that don't support them.
+func copyPath(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := createFile(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	}
+
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = copyPath(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
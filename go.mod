@@ -2,9 +2,14 @@ module github.com/synthesio/selfextract
 
 go 1.18
 
-require github.com/klauspost/compress v1.13.4
-
 require (
-	github.com/golang/snappy v0.0.3 // indirect
-	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510 // indirect
+	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
+	github.com/klauspost/compress v1.13.4
+	github.com/pierrec/lz4/v4 v4.1.17
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/term v0.15.0
 )
+
+require github.com/golang/snappy v0.0.3 // indirect
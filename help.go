@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// helpBlock reads the help text to embed in an archive, shown to its users
+// with --selfextract-help.
+func helpBlock(path string) (trailingBlock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return trailingBlock{}, err
+	}
+	return trailingBlock{typ: blockHelp, data: data}, nil
+}
+
+func (se *selfExtractor) printHelp() {
+	for _, b := range se.blocks {
+		if b.typ == blockHelp {
+			os.Stdout.Write(b.data)
+			return
+		}
+	}
+	exePath, _ := executable()
+	fmt.Printf("%s is a self-extracting archive, which has no help text.\n", exePath)
+	fmt.Printf("Run it with %sversion, %sconfig or %slist to learn more about it.\n", stubArgPrefix, stubArgPrefix, stubArgPrefix)
+}
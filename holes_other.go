@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd) && !stubonly
+
+package main
+
+import (
+	"io/fs"
+)
+
+// dataRegions doesn't find holes, as this platform can't tell where they are.
+func dataRegions(name string, info fs.FileInfo) ([]region, bool) {
+	return nil, false
+}
@@ -0,0 +1,53 @@
+//go:build (linux || darwin || freebsd) && !stubonly
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns the regions of the file name holding data, if it has
+// holes.
+func dataRegions(name string, info fs.FileInfo) ([]region, bool) {
+	size := info.Size()
+	// files with all their blocks allocated have no holes, which saves
+	// looking for them in most files
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int64(st.Blocks)*512 >= size {
+		return nil, false
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	var regions []region
+	var dataLen int64
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // only a hole is left
+		}
+		if err != nil {
+			return nil, false
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false
+		}
+		regions = append(regions, region{data, hole - data})
+		dataLen += hole - data
+		off = hole
+	}
+	// e.g. compressed filesystems allocate fewer blocks without holes
+	if dataLen == size {
+		return nil, false
+	}
+	return regions, true
+}
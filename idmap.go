@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// idRule maps the ids from first to last to the ones starting at to.
+type idRule struct {
+	first, last, to int
+}
+
+// idMap remaps user or group ids, e.g. the shifted ids of files created in a
+// user namespace by rootless container builds. Rules are written FROM:TO or
+// FIRST-LAST:TO for a range, e.g. 100000-165535:0.
+type idMap []idRule
+
+func (m *idMap) String() string {
+	var rules []string
+	for _, r := range *m {
+		if r.first == r.last {
+			rules = append(rules, fmt.Sprintf("%d:%d", r.first, r.to))
+		} else {
+			rules = append(rules, fmt.Sprintf("%d-%d:%d", r.first, r.last, r.to))
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set adds rules, separated by commas.
+func (m *idMap) Set(s string) error {
+	for _, rule := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(rule), ":")
+		if !ok {
+			return fmt.Errorf("id mapping must be FROM:TO or FIRST-LAST:TO: %q", rule)
+		}
+		first, last, isRange := strings.Cut(from, "-")
+		var r idRule
+		var err error
+		r.first, err = strconv.Atoi(first)
+		if err == nil {
+			r.last = r.first
+			if isRange {
+				r.last, err = strconv.Atoi(last)
+			}
+		}
+		if err == nil {
+			r.to, err = strconv.Atoi(to)
+		}
+		if err != nil || r.first < 0 || r.last < r.first || r.to < 0 {
+			return fmt.Errorf("invalid id mapping: %q", rule)
+		}
+		*m = append(*m, r)
+	}
+	return nil
+}
+
+// lookup returns the id an id is mapped to, and whether a rule matched.
+func (m idMap) lookup(id int) (int, bool) {
+	for _, r := range m {
+		if id >= r.first && id <= r.last {
+			return r.to + id - r.first, true
+		}
+	}
+	return id, false
+}
@@ -0,0 +1,17 @@
+//go:build !stubonly
+
+package main
+
+import "io/fs"
+
+// fileID identifies a file across its hard links.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLinkID returns the identity of a file that has several hard links.
+// Hard links are archived as separate files on Windows, where the file info
+// doesn't hold the identity of the files.
+func hardLinkID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
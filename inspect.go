@@ -0,0 +1,96 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// inspect prints what an archive is made of, without extracting it.
+func inspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s inspect [OPTION...] ARCHIVE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	verboseFlg := flags.Bool("v", false, "verbose output")
+	flags.Parse(args)
+	verbose = verbose || *verboseFlg
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		die("opening archive:", err)
+	}
+	defer f.Close()
+	payload, key, blocks := parseSelf(f)
+	if payload == nil {
+		die("not a selfextract archive:", flags.Arg(0))
+	}
+
+	key, _ = archiveKey(key, blocks)
+	fmt.Printf("key: %s (version %d)\n", hex.EncodeToString(key), keyVersion(key))
+	if p, ok := payload.(interface{ Size() int64 }); ok {
+		fmt.Println("payload size:", p.Size())
+	}
+	compression, _, err := detectCompression(payload, blocks)
+	if err != nil {
+		compression = err.Error()
+	}
+	fmt.Println("compression:", compression)
+	if size, ok := payloadSize(blocks); ok {
+		fmt.Println("uncompressed size:", size)
+	}
+	if info, ok := creatorBuildInfo(blocks); ok {
+		fmt.Println("created by:", info)
+	}
+	if m, ok := loadMetadata(blocks); ok {
+		data, _ := json.Marshal(m)
+		fmt.Println("metadata:", string(data))
+	}
+	if sum, ok := payloadDigest(blocks); ok {
+		fmt.Println("payload digest:", hex.EncodeToString(sum))
+	}
+	var names []string
+	for _, b := range blocks {
+		names = append(names, fmt.Sprintf("%s (%d bytes)", blockName(b.typ), len(b.data)))
+	}
+	if len(names) > 0 {
+		fmt.Println("trailing blocks:", strings.Join(names, ", "))
+	}
+}
+
+func blockName(typ uint32) string {
+	switch typ {
+	case blockBuildInfo:
+		return "build info"
+	case blockMessages:
+		return "messages"
+	case blockPayloadDigest:
+		return "payload digest"
+	case blockHelp:
+		return "help"
+	case blockBoundary:
+		return "boundary offset"
+	case blockSettings:
+		return "settings"
+	case blockPayloadSize:
+		return "uncompressed size"
+	case blockMetadata:
+		return "metadata"
+	case blockKey:
+		return "key"
+	case blockCompression:
+		return "compression"
+	}
+	return fmt.Sprintf("0x%08x", typ)
+}
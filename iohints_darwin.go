@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isNetworkFS reports whether f is on a network filesystem.
+func isNetworkFS(f *os.File) bool {
+	var st unix.Statfs_t
+	if unix.Fstatfs(int(f.Fd()), &st) != nil {
+		return false
+	}
+	switch unix.ByteSliceToString(st.Fstypename[:]) {
+	case "nfs", "smbfs", "afpfs", "webdav", "macfuse", "osxfuse":
+		return true
+	}
+	return false
+}
+
+// adviseSequential does nothing, as macOS reads ahead by default.
+func adviseSequential(f *os.File, off, n int64) {}
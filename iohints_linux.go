@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isNetworkFS reports whether f is on a network filesystem.
+func isNetworkFS(f *os.File) bool {
+	var st unix.Statfs_t
+	if unix.Fstatfs(int(f.Fd()), &st) != nil {
+		return false
+	}
+	switch uint32(st.Type) {
+	case unix.NFS_SUPER_MAGIC, unix.SMB_SUPER_MAGIC, unix.SMB2_SUPER_MAGIC,
+		unix.CIFS_SUPER_MAGIC, unix.V9FS_MAGIC, unix.CEPH_SUPER_MAGIC,
+		unix.AFS_SUPER_MAGIC, unix.AFS_FS_MAGIC, unix.CODA_SUPER_MAGIC,
+		unix.FUSE_SUPER_MAGIC:
+		// FUSE filesystems are mostly remote ones, e.g. sshfs or s3fs
+		return true
+	}
+	return false
+}
+
+// adviseSequential tells the system that the n bytes of f at off are about to
+// be read in order, which makes it read further ahead.
+func adviseSequential(f *os.File, off, n int64) {
+	err := unix.Fadvise(int(f.Fd()), off, n, unix.FADV_SEQUENTIAL)
+	if err == nil {
+		err = unix.Fadvise(int(f.Fd()), off, n, unix.FADV_WILLNEED)
+	}
+	if err != nil {
+		debug("cannot advise sequential reads of archive:", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+)
+
+func isNetworkFS(f *os.File) bool {
+	return false
+}
+
+func adviseSequential(f *os.File, off, n int64) {}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+)
+
+// ioProfile tunes how the archive is read, depending on where it is stored.
+// Network filesystems have a high latency per request, which bigger reads
+// amortize, while local disks are fastest reading as the decompressor asks.
+type ioProfile struct {
+	network   bool
+	scanBlock int  // size of the reads looking for the boundary
+	readBlock int  // size of the reads of the payload, as asked if zero
+	readahead bool // hint the system that the payload is read sequentially
+	noMmap    bool // scan the archive with reads rather than mapping it
+}
+
+// networkReadBlock is the size of the reads on network filesystems.
+const networkReadBlock = 1024 * 1024 // 1 MB
+
+// archiveIOProfile returns how to read the archive f. The environment
+// overrides the defaults, e.g. to compare them in benchmarks.
+func archiveIOProfile(f *os.File) ioProfile {
+	p := ioProfile{scanBlock: scanBlockSize, readahead: true}
+	if isNetworkFS(f) {
+		p.network = true
+		p.scanBlock = networkReadBlock
+		p.readBlock = networkReadBlock
+	}
+
+	if s := os.Getenv(EnvScanBlockSize); s != "" {
+		var size byteSize
+		if err := size.Set(s); err != nil || size <= 0 {
+			warn("ignoring invalid", EnvScanBlockSize+":", s)
+		} else {
+			p.scanBlock = int(size)
+			// the block size only matters when reading
+			p.noMmap = true
+		}
+	}
+	if s := os.Getenv(EnvReadBlockSize); s != "" {
+		var size byteSize
+		if err := size.Set(s); err != nil {
+			warn("ignoring invalid", EnvReadBlockSize+":", s)
+		} else {
+			p.readBlock = int(size)
+		}
+	}
+	if s := os.Getenv(EnvReadahead); s != "" {
+		p.readahead = isTruthy(s)
+	}
+	debug("archive on network filesystem:", p.network, "scan block:", p.scanBlock, "read block:", p.readBlock, "readahead:", p.readahead)
+	return p
+}
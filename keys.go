@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Keys identify the contents of an archive, so that an extraction dir holding
+// them can be reused. The version of the key tells how it is made:
+//
+//   - version 1 is the random keyLength bytes following the boundary, which
+//     every stub reads
+//   - version 2 is keyV2Length random bytes, recorded in a trailing block as
+//     the version followed by the key
+//
+// Content keys, of either version, are derived from the contents of the
+// archive instead of random, see deriveKeys.
+//
+// Archives with a key of a later version keep a version 1 key after the
+// boundary, which older stubs use instead, since they ignore the blocks they
+// don't know. Stubs accept extraction dirs made with either key.
+const (
+	keyV1 = 1
+	keyV2 = 2
+)
+
+// currentKeyVersion is the version of the keys of new archives.
+const currentKeyVersion = keyV2
+
+const keyV2Length = 32
+
+// generateKeyBlock returns the trailing block of a new key of the given
+// version, unless it is the version 1 key of the header.
+func generateKeyBlock(version int) (trailingBlock, bool) {
+	switch version {
+	case keyV1:
+		return trailingBlock{}, false
+	case keyV2:
+		data := make([]byte, 1+keyV2Length)
+		data[0] = keyV2
+		_, err := io.ReadFull(randomSource, data[1:])
+		if err != nil {
+			die("generating random key:", err)
+		}
+		return trailingBlock{typ: blockKey, data: data}, true
+	}
+	die("unsupported key version:", version)
+	return trailingBlock{}, false
+}
+
+// deriveKeys returns the version 1 content key of an archive, derived from the
+// digest of its uncompressed payload, and the trailing block of its key of the
+// given version, unless it is the version 1 one.
+func deriveKeys(contentDigest []byte, version int) ([]byte, trailingBlock, bool) {
+	derive := func(v int) []byte {
+		h := sha256.New()
+		fmt.Fprintf(h, "selfextract key v%d\x00", v)
+		h.Write(contentDigest)
+		return h.Sum(nil)
+	}
+	headerKey := derive(keyV1)[:keyLength]
+	switch version {
+	case keyV1:
+		return headerKey, trailingBlock{}, false
+	case keyV2:
+		data := append([]byte{keyV2}, derive(keyV2)[:keyV2Length]...)
+		return headerKey, trailingBlock{typ: blockKey, data: data}, true
+	}
+	die("unsupported key version:", version)
+	return nil, trailingBlock{}, false
+}
+
+// archiveKey returns the key of the archive, of the latest version this stub
+// knows, and the keys of previous versions that identify it too.
+func archiveKey(headerKey []byte, blocks []trailingBlock) ([]byte, [][]byte) {
+	for _, b := range blocks {
+		if b.typ != blockKey || len(b.data) == 0 {
+			continue
+		}
+		switch b.data[0] {
+		case keyV2:
+			if len(b.data) == 1+keyV2Length {
+				return b.data[1:], [][]byte{headerKey}
+			}
+		default:
+			debug("ignoring key of unknown version", b.data[0])
+		}
+	}
+	return headerKey, nil
+}
+
+// keyVersion returns the version of key, as returned by archiveKey.
+func keyVersion(key []byte) int {
+	if len(key) == keyV2Length {
+		return keyV2
+	}
+	return keyV1
+}
+
+// matchesKey reports whether the contents of a key file identify the archive,
+// with its current or a previous key.
+func (se *selfExtractor) matchesKey(keyData string) bool {
+	if hex.EncodeToString(se.key) == keyData {
+		return true
+	}
+	for _, key := range se.previousKeys {
+		if hex.EncodeToString(key) == keyData {
+			debug("extraction dir has a previous key of the archive")
+			return true
+		}
+	}
+	return false
+}
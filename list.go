@@ -0,0 +1,30 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// list prints the entries of the payload like tar -tv does, without
+// extracting anything.
+func (se *selfExtractor) list() {
+	tarRdr := se.getTarReader()
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			die("reading embedded tar:", err)
+		}
+		name := hdr.Name
+		if hdr.Typeflag == tar.TypeSymlink {
+			name += " -> " + hdr.Linkname
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			name += " link to " + hdr.Linkname
+		}
+		fmt.Printf("%s %10d %s %s\n", hdr.FileInfo().Mode(), hdr.Size, hdr.ModTime.Format("2006-01-02 15:04"), name)
+	}
+}
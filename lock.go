@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+)
+
+// pathLock is an advisory lock on a path, held through a lock file next to
+// it.
+type pathLock struct {
+	f *os.File
+}
+
+// lockPath waits until it gets an exclusive lock on path.
+func lockPath(path string) (*pathLock, error) {
+	lockPath := path + ".lock"
+	for {
+		f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// the previous holder removes the lock file when releasing it, in
+		// which case we locked a stale file and must try again
+		fInfo, err := f.Stat()
+		if err == nil {
+			var pInfo os.FileInfo
+			pInfo, err = os.Stat(lockPath)
+			if err == nil && os.SameFile(fInfo, pInfo) {
+				return &pathLock{f}, nil
+			}
+		}
+		f.Close()
+	}
+}
+
+// unlock releases the lock. It can be called several times, e.g. from a die
+// hook once already released.
+func (l *pathLock) unlock() {
+	if l.f == nil {
+		return
+	}
+	os.Remove(l.f.Name())
+	unlockFile(l.f)
+	l.f.Close()
+	l.f = nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	defaultLogMaxSize = 10 << 20
+	maxLogBackups     = 3
+)
+
+// rotatingFile is a log file that is rotated when it would grow bigger than
+// maxSize, keeping the previous contents as PATH.1, PATH.2... up to
+// maxLogBackups files.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, f: f, size: info.Size()}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := maxLogBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	err := os.Rename(r.path, r.path+".1")
+	if err != nil {
+		return err
+	}
+	r.f, err = os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	r.size = 0
+	return err
+}
+
+// childOutputs returns where the payload commands write their standard output
+// and error: the ones of the stub, or rotating files in SELFEXTRACT_LOG_DIR.
+func (se *selfExtractor) childOutputs() (io.Writer, io.Writer, error) {
+	se.logOnce.Do(func() {
+		se.stdout, se.stderr, se.logErr = se.openLogs()
+	})
+	return se.stdout, se.stderr, se.logErr
+}
+
+func (se *selfExtractor) openLogs() (io.Writer, io.Writer, error) {
+	dir := os.Getenv(EnvLogDir)
+	if dir == "" {
+		return os.Stdout, os.Stderr, nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(se.extractDir, dir)
+	}
+	maxSize := byteSize(defaultLogMaxSize)
+	if s := os.Getenv(EnvLogMaxSize); s != "" {
+		err := maxSize.Set(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", EnvLogMaxSize, err)
+		}
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := openRotatingFile(filepath.Join(dir, "stdout.log"), int64(maxSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := openRotatingFile(filepath.Join(dir, "stderr.log"), int64(maxSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	debug("writing the output of the commands to", dir)
+
+	if isTruthy(os.Getenv(EnvLogTee)) {
+		return io.MultiWriter(os.Stdout, stdout), io.MultiWriter(os.Stderr, stderr), nil
+	}
+	return stdout, stderr, nil
+}
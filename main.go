@@ -2,27 +2,67 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/sha512"
 	"encoding/binary"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"strconv"
 	"strings"
-	"time"
 )
 
 var verbose bool
 
-const (
-	EnvVerbose      = "SELFEXTRACT_VERBOSE"
-	EnvDir          = "SELFEXTRACT_DIR"
-	EnvStartup      = "SELFEXTRACT_STARTUP"
-	EnvCmdline      = "SELFEXTRACT_CMDLINE"
-	EnvExtractOnly  = "SELFEXTRACT_EXTRACT_ONLY"
-	EnvGraceTimeout = "SELFEXTRACT_GRACE_TIMEOUT"
+// veryVerbose adds costly details to the verbose output.
+var veryVerbose bool
+
+// envPrefix starts the names of the environment variables of selfextract.
+// Archives created with -env-prefix replace it, see setEnvPrefix.
+var envPrefix = "SELFEXTRACT_"
+
+var (
+	EnvVerbose       = "SELFEXTRACT_VERBOSE"
+	EnvDir           = "SELFEXTRACT_DIR"
+	EnvStartup       = "SELFEXTRACT_STARTUP"
+	EnvCmdline       = "SELFEXTRACT_CMDLINE"
+	EnvExtractOnly   = "SELFEXTRACT_EXTRACT_ONLY"
+	EnvGraceTimeout  = "SELFEXTRACT_GRACE_TIMEOUT"
+	EnvAllowTrailing = "SELFEXTRACT_ALLOW_TRAILING"
+	EnvOnConflict    = "SELFEXTRACT_ON_CONFLICT"
+	EnvMerge         = "SELFEXTRACT_MERGE"
+	EnvAuditFile     = "SELFEXTRACT_AUDIT_FILE"
+	EnvStatusFile    = "SELFEXTRACT_STATUS_FILE"
+	EnvLogDir        = "SELFEXTRACT_LOG_DIR"
+	EnvLogMaxSize    = "SELFEXTRACT_LOG_MAX_SIZE"
+	EnvLogTee        = "SELFEXTRACT_LOG_TEE"
+	EnvFirstRun      = "SELFEXTRACT_FIRST_RUN"
+	EnvKeepTmp       = "SELFEXTRACT_KEEP_TMP"
+	EnvOwnerMap      = "SELFEXTRACT_OWNER_MAP"
+	EnvGroupMap      = "SELFEXTRACT_GROUP_MAP"
+	EnvPassphrase    = "SELFEXTRACT_PASSPHRASE"
+
+	EnvPreserveSpecialBits = "SELFEXTRACT_PRESERVE_SPECIAL_BITS"
+	EnvPreserveOwner       = "SELFEXTRACT_PRESERVE_OWNER"
+	EnvNoMtime             = "SELFEXTRACT_NO_MTIME"
+	EnvPrecreateDirs       = "SELFEXTRACT_PRECREATE_DIRS"
+	EnvAllowUnsafePaths    = "SELFEXTRACT_ALLOW_UNSAFE_PATHS"
+	EnvExec                = "SELFEXTRACT_EXEC"
+	EnvScanBlockSize       = "SELFEXTRACT_SCAN_BLOCK_SIZE"
+	EnvReadBlockSize       = "SELFEXTRACT_READ_BLOCK_SIZE"
+	EnvReadahead           = "SELFEXTRACT_READAHEAD"
+	EnvJobs                = "SELFEXTRACT_JOBS"
+	EnvPlan                = "SELFEXTRACT_PLAN"
+	EnvVerify              = "SELFEXTRACT_VERIFY"
+	EnvExitCode            = "SELFEXTRACT_EXIT_CODE"
+	EnvCmd                 = "SELFEXTRACT_CMD"
+	EnvEntry               = "SELFEXTRACT_ENTRY"
+	EnvServer              = "SELFEXTRACT_SERVER"
+	EnvServerIdle          = "SELFEXTRACT_SERVER_IDLE"
+	EnvRunCount            = "SELFEXTRACT_RUN_COUNT"
+	EnvLastRun             = "SELFEXTRACT_LAST_RUN"
 )
 
 func init() {
@@ -33,36 +73,125 @@ func main() {
 	self := openSelf()
 	defer self.Close()
 
-	payload, key := parseSelf(self)
+	payload, key, blocks := parseSelf(self)
 
 	if payload != nil {
-		extract(payload, key)
+		extract(payload, key, blocks)
 		return
 	}
 
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "%s [OPTION...] FILE ...\n", os.Args[0])
-		flag.PrintDefaults()
+	runCreator(self)
+}
+
+// byteSize is a size in bytes, which can be given with a K, M, G or T suffix
+// (powers of 1024) on the command line.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
 	}
-	createName := flag.String("f", "selfextract.out", "name of the archive to create")
-	changeDir := flag.String("C", ".", "change dir before archiving files, only affects input files")
-	verboseFlg := flag.Bool("v", false, "verbose output")
-	flag.Parse()
-	verbose = verbose || *verboseFlg
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %q", s)
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+
+// stubArgPrefix marks the arguments reserved for the stub itself. They are
+// consumed by the stub and never forwarded to the payload command.
+const stubArgPrefix = "--selfextract-"
 
-	self.Seek(0, os.SEEK_SET)
-	create(self, key, *createName, flag.Args(), *changeDir)
+// stubOptions lists the reserved arguments known to the stub, and whether they
+// take a value.
+var stubOptions = map[string]bool{
+	"cmd":             true,
+	"install-service": true,
+	"install-task":    true,
+	"config":          false,
+	"dump":            false,
+	"dump-tar":        false,
+	"help":            false,
+	"list":            false,
+	"metadata":        false,
+	"porcelain":       false,
+	"verify":          false,
+	"version":         false,
+}
+
+// parseStubArgs separates the reserved arguments from the ones that must be
+// forwarded to the payload command, in their order. Values can be given
+// either as --selfextract-name=value or as --selfextract-name value. The
+// first -- ends the reserved arguments: it is forwarded with all the
+// arguments after it, unchanged, so that the command gets the end of its own
+// options and the arguments that look like reserved ones.
+func parseStubArgs(args []string) (map[string]string, []string) {
+	opts := make(map[string]string)
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, stubArgPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, stubArgPrefix), "=")
+		takesValue, ok := stubOptions[name]
+		if !ok {
+			die("unknown option:", arg)
+		}
+		if !takesValue && hasValue {
+			die("option takes no value:", arg)
+		}
+		if takesValue && !hasValue {
+			i++
+			if i == len(args) || args[i] == "--" {
+				die("missing value for option:", arg)
+			}
+			value = args[i]
+		}
+		opts[name] = value
+	}
+	return opts, rest
 }
 
 func debug(v ...interface{}) {
 	if verbose {
-		v = append([]interface{}{"selfextract:"}, v...)
+		v = append([]interface{}{colorize(colorDim, "selfextract:")}, v...)
 		log.Println(v...)
 	}
 }
 
+func warn(v ...interface{}) {
+	warnings.add(v...)
+	v = append([]interface{}{colorize(colorYellow, "selfextract: WARNING:")}, v...)
+	log.Println(v...)
+}
+
+// dieHooks are run before exiting on a fatal error, e.g. to remove partial
+// outputs.
+var dieHooks []func()
+
 func die(v ...interface{}) {
-	v = append([]interface{}{"selfextract: FATAL:"}, v...)
+	fatalError = strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	for i := len(dieHooks) - 1; i >= 0; i-- {
+		dieHooks[i]()
+	}
+	v = append([]interface{}{colorize(colorRed, "selfextract: FATAL:")}, v...)
 	log.Fatalln(v...)
 }
 
@@ -75,6 +204,28 @@ func isTruthy(s string) bool {
 	}
 }
 
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prompt asks a question on stderr and returns the answer read from stdin. The
+// answer is read byte by byte, so that no more than a line of input is taken
+// from what is meant for the payload command.
+func prompt(question string) string {
+	fmt.Fprint(os.Stderr, question)
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		answer = append(answer, b[0])
+	}
+	return strings.ToLower(strings.TrimSpace(string(answer)))
+}
+
 func generateBoundary() []byte {
 	h := sha512.Sum512([]byte("boundary"))
 	return h[:]
@@ -84,7 +235,7 @@ const keyLength = 16
 
 func generateRandomKey() []byte {
 	buf := make([]byte, keyLength)
-	_, err := rand.Read(buf)
+	_, err := io.ReadFull(randomSource, buf)
 	if err != nil {
 		die("generating random key:", err)
 	}
@@ -97,11 +248,11 @@ func generateRandomKey() []byte {
 const maxBoundaryOffset = 100e6 // 100 MB
 
 // efficient read size
-const scanBlockSize = 128*1024 // 128 KB
+const scanBlockSize = 128 * 1024 // 128 KB
 
 func openSelf() (io.ReadSeekCloser) {
- 	t := time.Now()
-	exePath, err := os.Executable()
+	defer timePhase("open")()
+	exePath, err := executable()
 	if err != nil {
 		panic(err)
 	}
@@ -109,63 +260,203 @@ func openSelf() (io.ReadSeekCloser) {
 	if err != nil {
 		die("opening itself:", exePath, err)
 	}
-	debug("opened itself in", time.Since(t))
+	// the archive may rename the environment variables, before any is read
+	if prefix := archiveEnvPrefix(self); prefix != "" {
+		setEnvPrefix(prefix)
+	}
 	return self
 }
 
-func parseSelf(self io.ReadSeeker) (io.Reader, []byte) {
-	bdyOff := 0
-	bufFull := false
-	buf := make([]byte, scanBlockSize)
+// findBoundary looks for the boundary in r, and returns its offset. Files are
+// memory-mapped when possible, which is much faster than reading them on
+// network filesystems.
+func findBoundary(r io.Reader) (int64, bool) {
+	blockSize := scanBlockSize
+	if f, ok := r.(*os.File); ok {
+		profile := archiveIOProfile(f)
+		blockSize = profile.scanBlock
+		if !profile.noMmap {
+			off, found, err := mmapFindBoundary(f)
+			if err == nil {
+				return off, found
+			}
+			debug("cannot map archive, reading it instead:", err)
+		}
+	}
+	return scanBoundary(r, blockSize)
+}
+
+// scanBoundary looks for the boundary by reading r block by block.
+func scanBoundary(r io.Reader, blockSize int) (int64, bool) {
 	boundary := generateBoundary()
-	t := time.Now()
+	buf := make([]byte, blockSize+len(boundary))
+	var bufOff int64 // offset of buf[0] in r
+	n := 0
 
-	for {
-		n, err := self.Read(buf)
+	for bufOff < maxBoundaryOffset {
+		m, err := r.Read(buf[n:])
+		n += m
+
+		bOff := bytes.Index(buf[:n], boundary)
+		if bOff >= 0 {
+			return bufOff + int64(bOff), true
+		}
 
 		if err == io.EOF {
-			bufFull = true
-			break
+			return 0, false
 		}
 
 		if err != nil {
-			die("reading itself:", err)
+			die("reading archive:", err)
 		}
 
-		bOff := bytes.Index(buf[:n], boundary)
-		if bOff >= 0 {
-			bdyOff += bOff
-			break
+		// keep the end of the block, the boundary may be split across reads
+		if keep := len(boundary) - 1; n > keep {
+			copy(buf, buf[n-keep:n])
+			bufOff += int64(n - keep)
+			n = keep
 		}
-		bdyOff += scanBlockSize
 	}
-	debug("boundary search completed in", time.Since(t))
+	return 0, false
+}
+
+// readHeader reads the key and payload size that follow the boundary found at
+// bdyOff, and returns them with the offset of the payload.
+func readHeader(r io.ReadSeeker, bdyOff int64) ([]byte, int64, int64, error) {
+	payloadOff := bdyOff + int64(len(generateBoundary())) + keyLength + 8
+	_, err := r.Seek(payloadOff-keyLength-8, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	buf := make([]byte, keyLength+8)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	key := buf[:keyLength]
+	rawValue := binary.LittleEndian.Uint64(buf[keyLength:][:8])
 
-	if bufFull {
+	if rawValue == 0xdeadbeefdeadbeef {
+		return nil, 0, 0, errors.New("invalid archive size")
+	}
+	// sizes and offsets are handled as int64 on every platform, including
+	// 32-bit ones
+	if rawValue > math.MaxInt64 {
+		return nil, 0, 0, fmt.Errorf("payload size out of range: %d", rawValue)
+	}
+
+	return key, payloadOff, int64(rawValue), nil
+}
+
+func parseSelf(self io.ReadSeeker) (io.Reader, []byte, []trailingBlock) {
+	bdyOff, found := locateBoundary(self, true)
+	if !found {
 		debug("cannot found boundary within threshold")
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	debug("boundary found at", bdyOff)
 
-	self.Seek(int64(bdyOff+len(boundary)), os.SEEK_SET)
-	buf = make([]byte, keyLength+8)
-	_, err := self.Read(buf)
+	key, payloadOff, payloadSize, err := readHeader(self, bdyOff)
 	if err != nil {
 		die("failed to read additional data from executable", err)
 	}
 
-	key := buf[:keyLength]
-	rawValue := binary.LittleEndian.Uint64(buf[keyLength:][:8])
+	blocks := checkPayloadSize(self, payloadOff, payloadSize)
+	var reader io.Reader = io.LimitReader(self, payloadSize)
+	if f, ok := self.(*os.File); ok {
+		profile := archiveIOProfile(f)
+		reader = &filePayload{io.NewSectionReader(f, payloadOff, payloadSize), f, payloadOff, profile}
+	} else if ra, ok := self.(io.ReaderAt); ok {
+		// the payload can be read again, e.g. after verifying it
+		reader = io.NewSectionReader(ra, payloadOff, payloadSize)
+	}
 
-	if rawValue == 0xdeadbeefdeadbeef {
-		die("Invalid archive size.")
+	debug("Payload size:", payloadSize)
+
+	return reader, key, blocks
+}
+
+// filePayload is a payload read from a file, which can be read again, and
+// whose data can be copied by the system from the file.
+type filePayload struct {
+	*io.SectionReader
+	file    *os.File
+	off     int64 // of the payload in file
+	profile ioProfile
+}
+
+// readAhead tells the system that the whole payload is about to be read, so
+// that it reads further ahead. Only the runs reading it call it, not to make
+// the system read the payload for nothing when the files are already
+// extracted.
+func readAhead(payload io.Reader) {
+	if p, ok := payload.(*filePayload); ok && p.profile.readahead {
+		adviseSequential(p.file, p.off, p.Size())
 	}
+}
 
-	payloadSize := int64(rawValue)
-	reader := io.LimitReader(self, payloadSize)
+// locateBoundary returns the offset of the boundary in r. It is recorded in a
+// trailing block by create, and also stamped into the stub, which is only
+// relevant when r is the running executable. Archives having neither, e.g.
+// made by older versions, are searched for the boundary.
+func locateBoundary(r io.ReadSeeker, running bool) (int64, bool) {
+	if off, ok := trailerBoundary(r); ok {
+		if checkBoundary(r, off) {
+			debug("using boundary offset of the trailing blocks")
+			return off, true
+		}
+		debug("no boundary at offset", off, "of the trailing blocks")
+	}
 
-	debug("Payload size:", payloadSize)
+	if off, ok := stampedBoundary(); ok && running {
+		if checkBoundary(r, off) {
+			debug("using stamped boundary offset")
+			return off, true
+		}
+		debug("no boundary at stamped offset", off)
+	}
+
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		die("seeking in archive:", err)
+	}
+	defer timePhase("boundary search")()
+	return findBoundary(r)
+}
+
+// checkPayloadSize validates the recorded payload size against the actual size
+// of the archive, so that truncated or concatenated archives are reported
+// before extracting anything. Data after the payload is accepted if it is made
+// of trailing blocks, which are returned. It leaves self positioned at the
+// payload start.
+func checkPayloadSize(self io.ReadSeeker, payloadOff, payloadSize int64) []trailingBlock {
+	var blocks []trailingBlock
+	end, err := self.Seek(0, io.SeekEnd)
+	if err != nil {
+		die("getting size of archive:", err)
+	}
 
-	return reader, key
+	remaining := end - payloadOff
+	switch {
+	case payloadSize > remaining:
+		die(fmt.Sprintf("archive is truncated or corrupted: payload should be %d bytes but only %d bytes are left after offset %d", payloadSize, remaining, payloadOff))
+	case payloadSize < remaining:
+		blocks, err = readTrailingBlocks(self, payloadOff+payloadSize, end)
+		if err == nil {
+			debug("found", len(blocks), "trailing blocks after the payload")
+		} else if !isTruthy(os.Getenv(EnvAllowTrailing)) {
+			die(fmt.Sprintf("archive has %d unexpected bytes after the payload (at offset %d), it may have been concatenated with other data (%v); set %s=1 to ignore them", remaining-payloadSize, payloadOff+payloadSize, err, EnvAllowTrailing))
+		} else {
+			blocks = readLeadingBlocks(self, payloadOff+payloadSize, end)
+			debug("ignoring unexpected data after", len(blocks), "trailing blocks")
+		}
+	}
+
+	_, err = self.Seek(payloadOff, io.SeekStart)
+	if err != nil {
+		die("seeking to payload:", err)
+	}
+	return blocks
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// catchDie runs f, and returns the fatal error it dies with, if any.
+func catchDie(f func()) (fatal string) {
+	type died struct{}
+	hooks := dieHooks
+	dieHooks = append(dieHooks, func() { panic(died{}) })
+	defer func() {
+		dieHooks = hooks
+		if r := recover(); r != nil {
+			if _, ok := r.(died); !ok {
+				panic(r)
+			}
+			fatal = fatalError
+		}
+	}()
+	f()
+	return ""
+}
+
+func TestParseStubArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		args  []string
+		opts  map[string]string
+		rest  []string
+		fatal string
+	}{
+		{"none", nil, map[string]string{}, nil, ""},
+		{"child args", []string{"-v", "--flag", "x"}, map[string]string{}, []string{"-v", "--flag", "x"}, ""},
+		{"reserved between child args", []string{"-v", "--selfextract-verify", "x"},
+			map[string]string{"verify": ""}, []string{"-v", "x"}, ""},
+		{"value with equals", []string{"--selfextract-install-service=my app"}, map[string]string{"install-service": "my app"}, nil, ""},
+		{"value as next arg", []string{"--selfextract-install-service", "--selfextract-list", "x"},
+			map[string]string{"install-service": "--selfextract-list"}, []string{"x"}, ""},
+		{"double dash alone", []string{"--"}, map[string]string{}, []string{"--"}, ""},
+		{"double dash repeated", []string{"--", "--", "x", "--"}, map[string]string{}, []string{"--", "--", "x", "--"}, ""},
+		{"reserved after double dash", []string{"--selfextract-list", "--", "--selfextract-version", "--selfextract-nope"},
+			map[string]string{"list": ""}, []string{"--", "--selfextract-version", "--selfextract-nope"}, ""},
+		{"child flags after double dash", []string{"--", "-h", "--help", "--selfextract-install-service=x"},
+			map[string]string{}, []string{"--", "-h", "--help", "--selfextract-install-service=x"}, ""},
+		{"unknown", []string{"--selfextract-nope"}, nil, nil, "unknown option"},
+		{"unexpected value", []string{"--selfextract-list=x"}, nil, nil, "takes no value"},
+		{"missing value", []string{"--selfextract-install-service"}, nil, nil, "missing value"},
+		{"double dash as value", []string{"--selfextract-install-service", "--", "x"}, nil, nil, "missing value"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts map[string]string
+			var rest []string
+			fatal := catchDie(func() { opts, rest = parseStubArgs(tc.args) })
+			if tc.fatal != "" || fatal != "" {
+				if !strings.Contains(fatal, tc.fatal) || tc.fatal == "" {
+					t.Fatalf("got fatal error %q, want %q", fatal, tc.fatal)
+				}
+				return
+			}
+			if !reflect.DeepEqual(opts, tc.opts) || !reflect.DeepEqual(rest, tc.rest) {
+				t.Errorf("got options %q and args %q, want %q and %q", opts, rest, tc.opts, tc.rest)
+			}
+		})
+	}
+}
+
+func TestSplitCmdline(t *testing.T) {
+	var long []string
+	for i := 0; i < 10000; i++ {
+		long = append(long, "arg"+strconv.Itoa(i))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cmdline string
+		dir     string
+		args    []string
+		err     string
+	}{
+		{"simple", "bin/app -v", "/x", []string{"bin/app", "-v"}, ""},
+		{"surrounding spaces", "  \tbin/app  -v \n", "/x", []string{"bin/app", "-v"}, ""},
+		{"quoted spaces", `app "a b" 'c  d' e\ f`, "/x", []string{"app", "a b", "c  d", "e f"}, ""},
+		{"quotes", `app "it's" '"quoted"' \"`, "/x", []string{"app", "it's", `"quoted"`, `"`}, ""},
+		{"quoted newline", "app 'a\nb'", "/x", []string{"app", "a\nb"}, ""},
+		{"newline between args", "app a\nb", "/x", []string{"app", "a", "b"}, ""},
+		{"extract dir with spaces", "__EXTRACT_DIR__/bin/app --data=__EXTRACT_DIR__/data", "/tmp/my dir",
+			[]string{"/tmp/my dir/bin/app", "--data=/tmp/my dir/data"}, ""},
+		{"extract dir with quotes", "__EXTRACT_DIR__/app", `/tmp/it's "here"`, []string{`/tmp/it's "here"/app`}, ""},
+		{"long argv", "app " + strings.Join(long, " "), "/x", append([]string{"app"}, long...), ""},
+		{"NUL", "app a\x00b", "/x", nil, "NUL character"},
+		{"unclosed quote", `app "a`, "/x", nil, "EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			se := &selfExtractor{extractDir: tc.dir}
+			args, err := se.splitCmdline(tc.cmdline)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("got args %q, want %q", args, tc.args)
+			}
+		})
+	}
+}
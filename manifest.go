@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// manifestPath is where the list of the extracted files is written, relative
+// to the extraction dir, so that the commands run can enumerate the files of
+// the archive without walking the extraction dir.
+var manifestPath = filepath.Join(".selfextract", "manifest.json")
+
+// digestRecord is the PAX record holding the SHA-256 digest of the files of
+// uncompressed payloads, which are copied without being read.
+const digestRecord = "SELFEXTRACT.sha256"
+
+type manifestEntry struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"` // file, dir, symlink or hardlink
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Target string      `json:"target,omitempty"` // of symlinks and hard links
+}
+
+func (se *selfExtractor) writeManifest(entries []manifestEntry) {
+	path := filepath.Join(se.extractDir, manifestPath)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		se.cleanupAndDie("creating manifest dir:", err)
+	}
+	data, err := json.MarshalIndent(struct {
+		Files []manifestEntry `json:"files"`
+	}{entries}, "", "  ")
+	if err != nil {
+		se.cleanupAndDie("encoding manifest:", err)
+	}
+	err = os.WriteFile(path, append(data, '\n'), 0644)
+	if err != nil {
+		se.cleanupAndDie("writing manifest:", err)
+	}
+}
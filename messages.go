@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// messages are the texts archives show to their end users, by id. Since
+// archives may ship to users who don't read English, they can be replaced by
+// translations at create time with -messages. Texts may contain placeholders
+// such as {dir}, which are replaced when shown.
+var messages = map[string]string{
+	"conflict-prompt": "extraction dir {dir} is not empty and was not created by this archive.\n[w]ipe it, [r]euse its contents, or [a]bort? ",
+	"conflict-abort":  "extraction dir must be empty or contain a valid key file (set {env} to wipe or reuse to proceed anyway)",
+	"no-temp-dir":     "creating temporary extraction directory, no usable location among: {dirs} - set {env} to use another one",
+	"expired":         "this archive expired at {date}",
+	"revoked":         "this archive was revoked by its publisher",
+}
+
+// msg returns the text of a message, with its placeholders replaced by the
+// values given as placeholder and value pairs.
+func msg(id string, replacements ...string) string {
+	return strings.NewReplacer(replacements...).Replace(messages[id])
+}
+
+// readMessages reads a JSON object of translated messages by id, and returns
+// it as a trailing block.
+func readMessages(path string) (trailingBlock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return trailingBlock{}, err
+	}
+	var translated map[string]string
+	err = json.Unmarshal(data, &translated)
+	if err != nil {
+		return trailingBlock{}, err
+	}
+	for id := range translated {
+		if _, ok := messages[id]; !ok {
+			var ids []string
+			for id := range messages {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			return trailingBlock{}, fmt.Errorf("unknown message id %q, expected one of: %s", id, strings.Join(ids, ", "))
+		}
+	}
+	data, err = json.Marshal(translated)
+	if err != nil {
+		return trailingBlock{}, err
+	}
+	return trailingBlock{typ: blockMessages, data: data}, nil
+}
+
+// loadMessages replaces the default messages by the translations recorded in
+// the archive, if any.
+func loadMessages(blocks []trailingBlock) {
+	for _, b := range blocks {
+		if b.typ != blockMessages {
+			continue
+		}
+		var translated map[string]string
+		err := json.Unmarshal(b.data, &translated)
+		if err != nil {
+			warn("ignoring invalid translated messages:", err)
+			return
+		}
+		for id, text := range translated {
+			messages[id] = text
+		}
+	}
+}
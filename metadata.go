@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"time"
+)
+
+// archiveMetadata describes what an archive holds, so that installers can
+// identify themselves without extracting anything. It is recorded in a
+// trailing block, as JSON.
+type archiveMetadata struct {
+	Name    string            `json:"name,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Created *time.Time        `json:"created,omitempty"`
+	Host    string            `json:"host,omitempty"` // where it was created
+	Meta    map[string]string `json:"meta,omitempty"` // given with -meta
+}
+
+// block returns the trailing block recording the metadata, stamped with the
+// time and the host of the creation, unless none was given. Reproducible
+// archives are only stamped with sourceDate, if not nil.
+func (m archiveMetadata) block(reproducible bool, sourceDate *time.Time) (trailingBlock, bool) {
+	if reflect.DeepEqual(m, archiveMetadata{}) {
+		return trailingBlock{}, false
+	}
+	if reproducible {
+		m.Created = sourceDate
+	} else {
+		created := clock.Now().UTC().Truncate(time.Second)
+		m.Created = &created
+		m.Host, _ = os.Hostname()
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		die("encoding archive metadata:", err)
+	}
+	return trailingBlock{typ: blockMetadata, data: data}, true
+}
+
+// loadMetadata returns the metadata recorded in the archive, if any.
+func loadMetadata(blocks []trailingBlock) (archiveMetadata, bool) {
+	var m archiveMetadata
+	for _, b := range blocks {
+		if b.typ == blockMetadata && json.Unmarshal(b.data, &m) == nil {
+			return m, true
+		}
+	}
+	return m, false
+}
+
+// printMetadata prints the metadata of the archive as JSON, or an empty
+// object if it has none.
+func (se *selfExtractor) printMetadata() {
+	m, _ := loadMetadata(se.blocks)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		die("encoding archive metadata:", err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
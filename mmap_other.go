@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFindBoundary(f *os.File) (int64, bool, error) {
+	return 0, false, errors.New("memory mapping not supported on this platform")
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFindBoundary looks for the boundary in a memory mapping of the
+// beginning of f, up to maxBoundaryOffset.
+func mmapFindBoundary(f *os.File) (int64, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	boundary := generateBoundary()
+	size := info.Size()
+	if limit := int64(maxBoundaryOffset) + int64(len(boundary)); size > limit {
+		size = limit
+	}
+	if size == 0 || int64(int(size)) != size {
+		return 0, false, errors.New("cannot map file of this size")
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return 0, false, err
+	}
+	defer syscall.Munmap(data)
+
+	off := bytes.Index(data, boundary)
+	return int64(off), off >= 0, nil
+}
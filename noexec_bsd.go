@@ -0,0 +1,17 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// isNoExec reports whether dir is on a filesystem mounted noexec, where the
+// extracted programs can't be run.
+func isNoExec(dir string) bool {
+	var st unix.Statfs_t
+	if unix.Statfs(dir, &st) != nil {
+		return false
+	}
+	return st.Flags&unix.MNT_NOEXEC != 0
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+func isNoExec(dir string) bool {
+	return false
+}
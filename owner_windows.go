@@ -0,0 +1,9 @@
+package main
+
+import "io/fs"
+
+// fileOwner returns the user and group ids owning a file, which files don't
+// have on Windows.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// extractionPlan is what running the archive would do, printed as JSON with
+// SELFEXTRACT_PLAN instead of doing it, to debug the choice of the extraction
+// dir where it fails.
+type extractionPlan struct {
+	Dir        string           `json:"dir"`
+	Temporary  bool             `json:"temporary"`
+	Reason     string           `json:"reason"`
+	DirState   string           `json:"dir_state,omitempty"` // of persistent dirs
+	Action     string           `json:"action"`
+	NoExec     bool             `json:"noexec,omitempty"`
+	Candidates []tempDirAttempt `json:"candidates,omitempty"`
+	Files      []manifestEntry  `json:"files,omitempty"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+var dirStateNames = map[extractDirState]string{
+	dirMissing:     "missing",
+	dirEmpty:       "empty",
+	dirNoKey:       "no key file",
+	dirKeyMatches:  "key matches",
+	dirKeyMismatch: "key doesn't match",
+}
+
+// printPlan prints where the payload would be extracted and why, and the
+// files that would be written. Nothing is written, except the empty dirs
+// created and removed to check the candidates for temporary dirs.
+func (se *selfExtractor) printPlan() {
+	var plan extractionPlan
+	if dir := os.Getenv(EnvDir); dir != "" {
+		plan.Dir = dir
+		plan.Reason = "set by " + EnvDir
+		if err := se.settings.checkExtractDir(dir); err != nil {
+			plan.Action = "abort"
+			plan.Errors = []string{err.Error()}
+		} else {
+			state := se.extractDirState(dir)
+			plan.DirState = dirStateNames[state]
+			plan.Action = se.plannedAction(state)
+			plan.NoExec = isNoExec(existingParent(dir))
+		}
+	} else {
+		need, _ := payloadSize(se.blocks)
+		dir, enough, attempts := tryTempExtractDirs(need)
+		for i := range attempts {
+			attempts[i].NoExec = isNoExec(attempts[i].Root)
+		}
+		plan.Temporary = true
+		plan.Candidates = attempts
+		plan.Action = "extract"
+		switch {
+		case dir == "":
+			plan.Reason = "no usable temporary dir"
+			plan.Action = "abort"
+		case enough:
+			plan.Reason = "first temporary dir with enough free space"
+		default:
+			plan.Reason = fmt.Sprintf("no temporary dir has the %d bytes needed, using the first usable one", need)
+		}
+		if dir != "" {
+			os.Remove(dir)
+			// the name of the dir is random
+			plan.Dir = filepath.Join(filepath.Dir(dir), "selfextract*")
+			plan.NoExec = isNoExec(filepath.Dir(dir))
+		}
+	}
+	if plan.Action != "reuse" && plan.Action != "abort" {
+		plan.Files, plan.Errors = se.plannedFiles()
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		die("encoding plan:", err)
+	}
+	fmt.Println(string(data))
+}
+
+// plannedAction tells what would be done with a persistent extraction dir,
+// like prepareExtractDir does.
+func (se *selfExtractor) plannedAction(state extractDirState) string {
+	merge := isTruthy(os.Getenv(EnvMerge))
+	switch state {
+	case dirKeyMatches:
+		return "reuse"
+	case dirKeyMismatch:
+		if merge {
+			return "merge"
+		}
+		return "wipe"
+	case dirNoKey:
+		if merge {
+			return "merge"
+		}
+		switch action := os.Getenv(EnvOnConflict); action {
+		case "wipe", "reuse", "abort":
+			return action
+		case "":
+			if isTerminal(os.Stdin) && isTerminal(os.Stderr) {
+				return "ask"
+			}
+			return "abort"
+		default:
+			return "invalid " + EnvOnConflict + ": " + action
+		}
+	}
+	return "extract"
+}
+
+// plannedFiles lists the entries of the payload that would be extracted, and
+// the errors extracting them would fail on.
+func (se *selfExtractor) plannedFiles() ([]manifestEntry, []string) {
+	se.parseUnsafePathsPolicy()
+	var files []manifestEntry
+	var errs []string
+	tarRdr := se.getTarReader()
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprint("reading embedded tar: ", err))
+			break
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		err = se.checkEntry(name, hdr)
+		if err != nil {
+			errs = append(errs, fmt.Sprint("unsafe entry in archive, ", err))
+			continue
+		}
+		entry := manifestEntry{
+			Path: filepath.ToSlash(name),
+			Mode: os.FileMode(hdr.Mode).Perm(),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			entry.Type, entry.Size = "file", hdr.Size
+		case tar.TypeDir:
+			entry.Type = "dir"
+		case tar.TypeSymlink:
+			entry.Type, entry.Target = "symlink", hdr.Linkname
+		case tar.TypeLink:
+			entry.Type, entry.Target = "hardlink", filepath.ToSlash(filepath.Clean(hdr.Linkname))
+		default:
+			errs = append(errs, fmt.Sprint("unsupported file type in tar ", hdr.Typeflag, ": ", hdr.Name))
+			continue
+		}
+		files = append(files, entry)
+	}
+	return files, errs
+}
+
+// existingParent returns the closest existing dir of a path, the path itself
+// if it exists.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// precreateWorkers is how many directories are created at once when they are
+// created before the files.
+const precreateWorkers = 16
+
+// precreateDirs creates the directories of the payload before extracting its
+// files, from the tar headers read in a first pass. Directories of a same
+// depth are created concurrently, which hides the latency of network
+// filesystems on large trees, at the cost of decompressing the payload twice.
+// It reports whether the directories were created.
+func (se *selfExtractor) precreateDirs() bool {
+	if !isTruthy(os.Getenv(EnvPrecreateDirs)) {
+		return false
+	}
+	payload, ok := se.payload.(io.ReadSeeker)
+	if !ok {
+		debug("payload can't be read twice, not creating directories first")
+		return false
+	}
+	defer timePhase("create dirs")()
+
+	// directories by depth, so that parents exist before their children
+	var levels [][]string
+	tarRdr := se.getTarReader()
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			se.cleanupAndDie("reading embedded tar:", err)
+		}
+		name := filepath.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeDir || name == "." {
+			continue
+		}
+		if se.checkEntry(name, hdr) != nil {
+			// reported when extracting it
+			continue
+		}
+		depth := strings.Count(name, string(filepath.Separator))
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], filepath.Join(se.extractDir, name))
+	}
+	_, err := payload.Seek(0, io.SeekStart)
+	if err != nil {
+		se.cleanupAndDie("seeking to start of payload:", err)
+	}
+
+	for _, dirs := range levels {
+		debug("creating", len(dirs), "directories")
+		err := mkdirConcurrently(dirs)
+		if err != nil {
+			se.cleanupAndDie("creating directory", err)
+		}
+	}
+	return true
+}
+
+// mkdirConcurrently creates the dirs with a few workers, ignoring the ones
+// that exist, and returns the first error.
+func mkdirConcurrently(dirs []string) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	work := make(chan string)
+	for i := 0; i < precreateWorkers && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range work {
+				err := os.Mkdir(dir, 0755)
+				if err != nil && !os.IsExist(err) {
+					once.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		work <- dir
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,44 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sourceDateEpoch returns the time set by SOURCE_DATE_EPOCH, the convention
+// of reproducible builds for the time of the sources, if any.
+func sourceDateEpoch() (*time.Time, error) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return nil, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %q", s)
+	}
+	t := time.Unix(secs, 0).UTC()
+	return &t, nil
+}
+
+// normalizeHeader strips what depends on where and when the files were
+// created from the header of an entry of a reproducible archive: the owners
+// are root, and modification times are clamped to SOURCE_DATE_EPOCH, or
+// zeroed without it, which leaves extracted files with the extraction time.
+func normalizeHeader(hdr *tar.Header, sourceDate *time.Time) {
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	switch {
+	case sourceDate == nil:
+		hdr.ModTime = time.Unix(0, 0)
+	case hdr.ModTime.After(*sourceDate):
+		hdr.ModTime = *sourceDate
+	default:
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	}
+}
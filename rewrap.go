@@ -0,0 +1,154 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rewrap creates an archive from the payload of an existing one, so that
+// artifacts can be moved to a newer stub or recompressed without their
+// original files. The key and the trailing blocks of other tools are kept, so
+// that the new archive reuses the extraction directories of the old one.
+// Files given after the archive replace its entries of the same path or are
+// added to them, e.g. to inject configuration into a prebuilt installer; the
+// new archive then gets a key of its own.
+func rewrap(self io.ReadSeeker, args []string) {
+	flags := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s rewrap [OPTION...] ARCHIVE [FILE...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var opts createOptions
+	flags.StringVar(&opts.out, "f", "selfextract.out", "name of the archive to create")
+	flags.StringVar(&opts.dir, "C", ".", "change dir before adding files, which can be repeated among the files like when creating archives")
+	stubPath := flags.String("stub", "", "use the selfextract executable `FILE` as stub instead of this one")
+	flags.Var(&opts.maxSize, "max-size", "fail if the archive is bigger than `SIZE` (e.g. 500M)")
+	flags.Var(&opts.compression, "z", "compress with `ALGO`: "+strings.Join(compressionNames(), ", ")+" (default zstd)")
+	flags.StringVar(&opts.escrow, "escrow", "", "append the key, digest and encryption settings of the archive to `FILE`, as a line of JSON, for the records of its publisher")
+	encryptFlg := flags.Bool("encrypt", false, "encrypt the payload with AES-256-GCM, with a passphrase from "+EnvPassphrase+" or asked on the terminal")
+	flags.IntVar(&opts.jobs, "j", 0, "compress with zstd on `N` threads, 1 for a single zstd frame (default: all the cores)")
+	flags.IntVar(&opts.level, "level", 0, "compress with zstd level `N`, from 1 (fastest, the default) to 22 (smallest)")
+	flags.StringVar(&opts.packStub, "pack-stub", "", "shrink the stub with the executable packer `COMMAND`, run with the path of the stub to pack in place, e.g. \"upx --best --lzma\"")
+	flags.Var(&opts.long, "long", "use a large compression window of 2^WINDOWLOG bytes (default 27) to find matches far apart, as -long or -long=WINDOWLOG")
+	verboseFlg := flags.Bool("v", false, "verbose output")
+	flags.Parse(args)
+	verbose = verbose || *verboseFlg
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts.files = parseInputFiles(opts.dir, flags.Args()[1:])
+	if (opts.long != 0 || opts.level != 0 || opts.jobs != 0) && opts.compression != "" && opts.compression != "zstd" {
+		die("-long, -level and -j only apply to zstd compression")
+	}
+	if opts.jobs < 0 {
+		die("-j must be at least 1")
+	}
+	if opts.level < 0 || opts.level > 22 {
+		die("compression level must be between 1 and 22")
+	}
+	if *encryptFlg {
+		var err error
+		opts.passphrase, err = readPassphrase(true)
+		if err != nil {
+			die("reading passphrase:", err)
+		}
+	}
+
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		die("opening archive to rewrap:", err)
+	}
+	defer in.Close()
+	payload, key, blocks := parseSelf(in)
+	if payload == nil {
+		die("not a selfextract archive:", flags.Arg(0))
+	}
+	readAhead(payload)
+	zRdr, err := newDecompressor(payload, blocks)
+	if err != nil {
+		die("creating decompressor:", err)
+	}
+	defer zRdr.Close()
+	opts.tarInput = zRdr
+
+	if len(opts.files) > 0 {
+		// other contents must not reuse the extraction dirs of the old
+		// archive, the new key has the version of the old one
+		oldKey, _ := archiveKey(key, blocks)
+		opts.keyVersion = keyVersion(oldKey)
+		key = nil
+		opts.replaced = replacedPaths(opts.files, opts.walk)
+	}
+
+	opts.blocks = []trailingBlock{}
+	for _, b := range blocks {
+		// translations, help, settings, metadata and keys are kept, unlike
+		// the build information
+		if b.typ == blockKey && key == nil {
+			continue
+		}
+		if !ownBlock(b) || b.typ == blockMessages || b.typ == blockHelp || b.typ == blockSettings || b.typ == blockMetadata || b.typ == blockKey {
+			opts.blocks = append(opts.blocks, b)
+		}
+	}
+
+	stub := self
+	if *stubPath != "" {
+		f, err := os.Open(*stubPath)
+		if err != nil {
+			die("opening stub:", err)
+		}
+		defer f.Close()
+		stub = f
+		if p, _, _ := parseSelf(stub); p != nil {
+			die("stub is an archive, not a selfextract executable:", *stubPath)
+		}
+		_, err = stub.Seek(0, io.SeekStart)
+		if err != nil {
+			die("seeking in stub:", err)
+		}
+		data, err := io.ReadAll(stub)
+		if err != nil {
+			die("reading stub:", err)
+		}
+		adaptToStub(&opts, stubCapabilities(data))
+	}
+	_, err = stub.Seek(0, io.SeekStart)
+	if err != nil {
+		die("seeking in stub:", err)
+	}
+
+	create(stub, key, opts)
+}
+
+// replacedPaths returns the paths the files to archive have in the archive,
+// with their parent directories, which are already in the archive or created
+// with them when extracting.
+func replacedPaths(files []inputFile, opts walkOptions) map[string]bool {
+	replaced := make(map[string]bool)
+	for _, input := range files {
+		err := walkInput(input.dir, filepath.ToSlash(input.path), opts, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			for p := name; p != "." && p != "/" && !replaced[p]; p = path.Dir(p) {
+				replaced[p] = true
+			}
+			return nil
+		})
+		if err != nil {
+			die("walking input files:", err)
+		}
+	}
+	return replaced
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkEntry reports the entries of the payload that would be extracted, or
+// whose links would point, outside of the extraction dir, like
+// ../../etc/cron.d/x, unless the archive is trusted with
+// SELFEXTRACT_ALLOW_UNSAFE_PATHS. The paths are only checked as written, so
+// the entries extracted through symlinks, whose chains can escape, are
+// refused by checkParents, and the targets of symlinks are resolved on disk by
+// checkLinkTarget.
+func (se *selfExtractor) checkEntry(name string, hdr *tar.Header) error {
+	if se.allowUnsafePaths {
+		return nil
+	}
+	return checkEntryPath(name, hdr)
+}
+
+// checkEntryPath reports the entries that would escape the extraction dir,
+// named by their cleaned path.
+func checkEntryPath(name string, hdr *tar.Header) error {
+	if !isLocalPath(name) {
+		return fmt.Errorf("path %s is outside of the extraction dir", hdr.Name)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		// relative to the directory of the symlink
+		target := filepath.Join(filepath.Dir(name), filepath.FromSlash(hdr.Linkname))
+		if isAbsPath(hdr.Linkname) || !isLocalPath(target) {
+			return fmt.Errorf("symlink %s points outside of the extraction dir: %s", hdr.Name, hdr.Linkname)
+		}
+	case tar.TypeLink:
+		// relative to the extraction dir
+		if !isLocalPath(hdr.Linkname) {
+			return fmt.Errorf("hard link %s points outside of the extraction dir: %s", hdr.Name, hdr.Linkname)
+		}
+	}
+	return nil
+}
+
+// checkParents reports the entries whose parent dirs, as they are on disk in
+// dir, go through a symlink, which would have them extracted wherever it
+// points.
+func checkParents(dir, name string) error {
+	parent := dir
+	for _, elem := range strings.Split(filepath.Dir(name), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		parent = filepath.Join(parent, elem)
+		info, err := os.Lstat(parent)
+		if err != nil {
+			// neither it nor its children exist yet
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path %s goes through the symlink %s", name, parent)
+		}
+	}
+	return nil
+}
+
+// maxLinkDepth is the number of symlinks resolved in a path before giving up,
+// as the systems do.
+const maxLinkDepth = 40
+
+// checkLinkTarget reports the symlinks whose target, once resolved through
+// the symlinks already in dir, points outside of it: the targets are checked
+// lexically too, but a/.. is the parent of dir when a points to its parent.
+func checkLinkTarget(dir, name, target string) error {
+	depth := 0
+	_, err := resolveInDir(dir, filepath.Dir(name), filepath.FromSlash(target), &depth)
+	if err != nil {
+		return fmt.Errorf("symlink %s points outside of the extraction dir: %s: %w", name, target, err)
+	}
+	return nil
+}
+
+// resolveInDir resolves path, relative to cur in dir, through the symlinks in
+// dir, and returns it relative to dir. It fails when the path leaves dir.
+func resolveInDir(dir, cur, path string, depth *int) (string, error) {
+	if isAbsPath(path) {
+		return "", fmt.Errorf("absolute path %s", path)
+	}
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if cur == "." {
+				return "", fmt.Errorf("path goes above the extraction dir")
+			}
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, elem)
+		info, err := os.Lstat(filepath.Join(dir, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		*depth++
+		if *depth > maxLinkDepth {
+			return "", fmt.Errorf("too many levels of symlinks")
+		}
+		link, err := os.Readlink(filepath.Join(dir, next))
+		if err != nil {
+			return "", err
+		}
+		// relative to the dir of the symlink
+		cur, err = resolveInDir(dir, cur, link, depth)
+		if err != nil {
+			return "", err
+		}
+	}
+	return cur, nil
+}
+
+// isLocalPath reports whether a relative path stays inside the dir it is
+// relative to.
+func isLocalPath(name string) bool {
+	if isAbsPath(name) {
+		return false
+	}
+	name = filepath.Clean(filepath.FromSlash(name))
+	return name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
+
+// isAbsPath reports whether a path is absolute, including the paths that are
+// only absolute on some systems, like /etc on Windows.
+func isAbsPath(name string) bool {
+	name = filepath.FromSlash(name)
+	return filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator))
+}
+
+func (se *selfExtractor) parseUnsafePathsPolicy() {
+	se.allowUnsafePaths = isTruthy(os.Getenv(EnvAllowUnsafePaths))
+	if se.allowUnsafePaths {
+		debug("extracting paths outside of the extraction dir, as allowed by", EnvAllowUnsafePaths)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a tar made by buildTar, with the contents of files.
+type tarEntry struct {
+	hdr  *tar.Header
+	data string
+}
+
+// buildTar returns a tar of entries, whose size is the one of their contents.
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if e.hdr.Typeflag == tar.TypeReg {
+			e.hdr.Size = int64(len(e.data))
+		}
+		err := tw.WriteHeader(e.hdr)
+		if err == nil {
+			_, err = tw.Write([]byte(e.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractTar extracts the entries of a tar into dir, and returns the fatal
+// error it dies with, if any.
+func extractTar(t *testing.T, dir string, entries []*tar.Header) string {
+	t.Helper()
+	var tarEntries []tarEntry
+	for _, hdr := range entries {
+		var data string
+		if hdr.Typeflag == tar.TypeReg {
+			data = strings.Repeat("\x00", int(hdr.Size))
+		}
+		tarEntries = append(tarEntries, tarEntry{hdr, data})
+	}
+	se := &selfExtractor{payload: bytes.NewReader(buildTar(t, tarEntries)), extractDir: dir}
+	return catchDie(se.extract)
+}
+
+func TestExtractSymlinkChain(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []*tar.Header
+		unsafe  bool
+	}{
+		{"symlink through a symlink", []*tar.Header{
+			// each symlink points inside the extraction dir, but a/b
+			// resolves to its parent
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "."},
+			{Typeflag: tar.TypeSymlink, Name: "a/b", Linkname: ".."},
+			{Typeflag: tar.TypeReg, Name: "b/escaped.txt", Size: 4, Mode: 0644},
+		}, true},
+		{"file replacing a symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "y", Linkname: "."},
+			{Typeflag: tar.TypeSymlink, Name: "x", Linkname: "y/../escaped.txt"},
+			{Typeflag: tar.TypeReg, Name: "x", Size: 4, Mode: 0644},
+		}, true},
+		{"symlink before the one it goes through", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "x", Linkname: "y/../escaped.txt"},
+			{Typeflag: tar.TypeSymlink, Name: "y", Linkname: "."},
+		}, true},
+		{"hard link through a symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "y", Linkname: "."},
+			{Typeflag: tar.TypeSymlink, Name: "z", Linkname: "y/../escaped.txt"},
+			{Typeflag: tar.TypeLink, Name: "h", Linkname: "z"},
+		}, true},
+		{"symlinks inside", []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "lib64", Mode: 0755},
+			{Typeflag: tar.TypeReg, Name: "lib64/f", Size: 4, Mode: 0644},
+			{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "lib64"},
+			{Typeflag: tar.TypeDir, Name: "bin", Mode: 0755},
+			{Typeflag: tar.TypeSymlink, Name: "bin/f", Linkname: "../lib/f"},
+			{Typeflag: tar.TypeSymlink, Name: "bin/g", Linkname: "../lib/../bin/f"},
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := filepath.Join(t.TempDir(), "parent")
+			dir := filepath.Join(parent, "dir")
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the target of the escaping symlinks
+			victim := filepath.Join(parent, "escaped.txt")
+			err = os.WriteFile(victim, []byte("keep"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fatal := extractTar(t, dir, tc.entries)
+			if tc.unsafe != strings.Contains(fatal, "unsafe entry in archive") {
+				t.Errorf("got fatal error %q, want an unsafe entry: %v", fatal, tc.unsafe)
+			}
+			data, err := os.ReadFile(victim)
+			if err != nil || string(data) != "keep" {
+				t.Errorf("file outside of the extraction dir overwritten: %q, %v", data, err)
+			}
+			entries, _ := os.ReadDir(parent)
+			if len(entries) != 2 {
+				t.Errorf("got %d files next to the extraction dir, want 2", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// openNoFollow makes opening a file fail if it is a symlink.
+const openNoFollow = syscall.O_NOFOLLOW
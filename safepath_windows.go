@@ -0,0 +1,5 @@
+package main
+
+// openNoFollow makes opening a file fail if it is a symlink, which the flags
+// of os.OpenFile can't on Windows: the symlinks are removed beforehand.
+const openNoFollow = 0
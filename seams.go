@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"time"
+)
+
+// The process reaches the clock, the random generator and its own executable
+// through the variables below, so that tests can replace them to exercise
+// expiry dates, timeouts, key generation and the paths derived from the
+// archive deterministically, without sleeping or building archives.
+var (
+	clock        clockSource = realClock{}
+	randomSource io.Reader   = rand.Reader
+	executable               = os.Executable
+)
+
+// clockSource tells the time and waits.
+type clockSource interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only passes when waiting, all at once.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.now = c.now.Add(d)
+	f()
+}
+
+// useClock replaces the clock for the duration of the test.
+func useClock(t *testing.T, c clockSource) {
+	t.Helper()
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+}
+
+func TestCheckExpiry(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		now     time.Time
+		expires *time.Time
+		expired bool
+	}{
+		{"no expiry", expires.AddDate(10, 0, 0), nil, false},
+		{"before", expires.Add(-time.Second), &expires, false},
+		{"at", expires, &expires, true},
+		{"after", expires.AddDate(0, 0, 1), &expires, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useClock(t, &fakeClock{now: tc.now})
+			se := &selfExtractor{}
+			se.settings.Expires = tc.expires
+			fatal := catchDie(se.checkExpiry)
+			if expired := fatal != ""; expired != tc.expired {
+				t.Errorf("got fatal error %q, want expired: %v", fatal, tc.expired)
+			}
+		})
+	}
+}
+
+func TestWaitOutputsTimeout(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	useClock(t, c)
+	se := &selfExtractor{}
+	// a command whose output is never closed
+	se.running.Add(1)
+	defer se.running.Done()
+	se.waitOutputs()
+	if waited := c.now.Sub(time.Unix(0, 0)); waited != outputDrainTimeout {
+		t.Errorf("waited %v for the outputs, want %v", waited, outputDrainTimeout)
+	}
+}
+
+func TestGenerateRandomKey(t *testing.T) {
+	prev := randomSource
+	defer func() { randomSource = prev }()
+
+	random := bytes.Repeat([]byte{7}, keyLength)
+	randomSource = bytes.NewReader(random)
+	key := generateRandomKey()
+	if !bytes.Equal(key, random) {
+		t.Errorf("got key %x, want %x", key, random)
+	}
+
+	randomSource = bytes.NewReader(random[:keyLength-1])
+	fatal := catchDie(func() { generateRandomKey() })
+	if !strings.Contains(fatal, "generating random key") {
+		t.Errorf("got fatal error %q for a short random source", fatal)
+	}
+}
+
+func TestTempDirCandidates(t *testing.T) {
+	prev := executable
+	defer func() { executable = prev }()
+
+	exeDir := filepath.Join(t.TempDir(), "bin")
+	executable = func() (string, error) { return filepath.Join(exeDir, "archive"), nil }
+	candidates := tempDirCandidates()
+	if last := candidates[len(candidates)-1]; last != exeDir {
+		t.Errorf("got %s as the last candidate, want the dir of the archive %s", last, exeDir)
+	}
+
+	executable = func() (string, error) { return "", errors.New("unknown") }
+	for _, dir := range tempDirCandidates() {
+		if dir == exeDir || dir == "." {
+			t.Errorf("got candidate %s without a known archive", dir)
+		}
+	}
+}
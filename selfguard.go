@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The extraction dir may be the directory of the archive itself, so
+// extracting and cleaning up must take care not to overwrite or remove the
+// running archive.
+
+var archivePathOnce struct {
+	sync.Once
+	path string
+}
+
+// runningArchive returns the resolved path of the running archive, or an
+// empty string if it is unknown.
+func runningArchive() string {
+	archivePathOnce.Do(func() {
+		exePath, err := executable()
+		if err != nil {
+			return
+		}
+		exePath, err = filepath.EvalSymlinks(exePath)
+		if err != nil {
+			return
+		}
+		archivePathOnce.path = exePath
+	})
+	return archivePathOnce.path
+}
+
+// isRunningArchive reports whether path is the running archive.
+func isRunningArchive(path string) bool {
+	archive := runningArchive()
+	if archive == "" || !strings.EqualFold(filepath.Base(path), filepath.Base(archive)) {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	archiveInfo, err := os.Stat(archive)
+	return err == nil && os.SameFile(pathInfo, archiveInfo)
+}
+
+// holdsRunningArchive reports whether the running archive is in the directory
+// at path.
+func holdsRunningArchive(path string) bool {
+	archive := runningArchive()
+	if archive == "" {
+		return false
+	}
+	path, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(path, filepath.Dir(archive))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
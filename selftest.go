@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// verifyArchive reads the whole payload without writing anything: it checks
+// the payload against its digest, then that it decompresses to a well-formed
+// tar whose entries would all be extracted, and whose files match the digests
+// they record, and returns how many there are.
+func verifyArchive(payload io.Reader, blocks []trailingBlock) (int, error) {
+	readAhead(payload)
+	if want, ok := payloadDigest(blocks); ok {
+		if p, ok := payload.(io.ReadSeeker); ok {
+			err := checkDigest(p, want)
+			if err != nil {
+				return 0, err
+			}
+			debug("payload digest verified")
+		}
+	} else {
+		warn("archive has no payload digest, only checking that it can be read")
+	}
+
+	zRdr, err := newDecompressor(payload, blocks)
+	if err != nil {
+		return 0, fmt.Errorf("reading payload: %w", err)
+	}
+	defer zRdr.Close()
+	allowUnsafePaths := isTruthy(os.Getenv(EnvAllowUnsafePaths))
+	tarRdr := tar.NewReader(zRdr)
+	entries := 0
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading embedded tar: %w", err)
+		}
+		if name := filepath.Clean(hdr.Name); name != "." && !allowUnsafePaths {
+			err = checkEntryPath(name, hdr)
+			if err != nil {
+				return 0, err
+			}
+		}
+		// reading the contents checks the whole compressed stream, and
+		// the files recording their digest against it
+		want, hasDigest := hdr.PAXRecords[digestRecord]
+		h := sha256.New()
+		var w io.Writer = io.Discard
+		if hasDigest {
+			w = h
+		}
+		_, err = io.Copy(w, tarRdr)
+		if err != nil {
+			return 0, fmt.Errorf("reading embedded tar: %w", err)
+		}
+		if hasDigest {
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != want {
+				return 0, fmt.Errorf("digest of %s is %s instead of %s", hdr.Name, sum, want)
+			}
+		}
+		entries++
+	}
+	return entries, nil
+}
+
+// selfTest verifies the archive itself, for pipelines to check what they
+// built or downloaded with the stub only, and exits with 1 if it is broken.
+func (se *selfExtractor) selfTest() {
+	entries, err := verifyArchive(se.payload, se.blocks)
+	if err != nil {
+		die(err)
+	}
+	fmt.Printf("OK, %d entries\n", entries)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVerifyArchiveDigests(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	file := func(name, digest string) tarEntry {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}
+		if digest != "" {
+			hdr.PAXRecords = map[string]string{digestRecord: digest}
+		}
+		return tarEntry{hdr, "data"}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		entries []tarEntry
+		err     string
+	}{
+		{"no digests", []tarEntry{file("a", ""), file("b", "")}, ""},
+		{"matching digests", []tarEntry{file("a", hex.EncodeToString(sum[:])), file("b", "")}, ""},
+		{"mismatching digest", []tarEntry{file("a", hex.EncodeToString(sum[:])), file("b", strings.Repeat("0", 64))}, "digest of b is"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := verifyArchive(bytes.NewReader(buildTar(t, tc.entries)), nil)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries != len(tc.entries) {
+				t.Errorf("got %d entries, want %d", entries, len(tc.entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Archives created with -server run their command through a server: the
+// first run starts it in the background, where it extracts the payload and
+// listens on a unix socket, and each run, the first one included, hands its
+// arguments, environment, working dir and standard streams to it, then waits
+// for the exit code of the command. The next runs then skip the extraction,
+// which makes frequently invoked tools start faster. The server stops once
+// idle for SELFEXTRACT_SERVER_IDLE seconds.
+
+// serverDaemon is the value of SELFEXTRACT_SERVER telling the stub it was
+// started as the server.
+const serverDaemon = "daemon"
+
+const defaultServerIdle = 10 * time.Minute
+
+// serverRequest is sent by the runs of the archive to the server, after their
+// standard streams.
+type serverRequest struct {
+	Args  []string `json:"args"`
+	Env   []string `json:"env"`
+	Dir   string   `json:"dir"`
+	Entry string   `json:"entry,omitempty"`
+}
+
+// serverMessage is sent by the server when the command started and when it
+// exited, and by the runs of the archive when they receive signals, for the
+// server to forward them to the command.
+type serverMessage struct {
+	Started bool   `json:"started,omitempty"`
+	Exit    *int   `json:"exit,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Signal  int    `json:"signal,omitempty"`
+}
+
+// forwardedSignals are the signals the runs of the archive forward to the
+// commands run by the server, which aren't their children.
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP}
+
+// useServer tells whether the command is run through the server of the
+// archive.
+func (se *selfExtractor) useServer() bool {
+	mode := os.Getenv(EnvServer)
+	if !isTruthy(mode) && (mode != "" || !se.settings.Server) {
+		return false
+	}
+	if _, ok := se.commandOverride(); ok || se.extractOnly || isService() {
+		debug("running without the server, which only runs the command of the archive")
+		return false
+	}
+	var reason string
+	switch {
+	case !serverSupported:
+		reason = "isn't supported on this platform"
+	case os.Getenv(EnvLogDir) != "":
+		reason = "can't write the output of the command to " + EnvLogDir
+	case os.Getenv(EnvStatusFile) != "":
+		reason = "can't write the status file with the exit code of the command"
+	default:
+		return true
+	}
+	warn("running the command without the server, since it", reason)
+	return false
+}
+
+// serverIdleTimeout returns how long the server waits for commands to run
+// before stopping.
+func serverIdleTimeout() time.Duration {
+	idle := defaultServerIdle
+	if idleStr := os.Getenv(EnvServerIdle); idleStr != "" {
+		idleFl, err := strconv.ParseFloat(idleStr, 64)
+		if err == nil && idleFl > 0 {
+			idle = time.Duration(idleFl * float64(time.Second))
+		}
+	}
+	return idle
+}
+
+// serverSocket returns the path of the socket of the server of the archive,
+// which is shared by the runs with the same key, settings, stub and
+// extraction dir. Archives with the same key may run other commands with
+// other settings, e.g. when created with -content-key, and other stubs may
+// not understand the requests of this one.
+func (se *selfExtractor) serverSocket() (string, error) {
+	dir, err := serverDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(se.key)
+	h.Write([]byte{0})
+	h.Write([]byte(os.Getenv(EnvDir)))
+	for _, b := range se.blocks {
+		if b.typ == blockSettings || b.typ == blockBuildInfo {
+			h.Write([]byte{0})
+			h.Write(b.data)
+		}
+	}
+	return filepath.Join(dir, hex.EncodeToString(h.Sum(nil)[:8])+".sock"), nil
+}
+
+func dialServer(path string) (*net.UnixConn, error) {
+	return net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+}
+
+// runClient runs the command through the server of the archive, starting it
+// if none is listening, and returns its exit code. It returns false when the
+// server can't be used, for the archive to run the command itself.
+func (se *selfExtractor) runClient() (int, bool) {
+	se.checkExpiry()
+	se.checkRevocation()
+	se.checkDirOverride()
+	entry := se.selectEntry()
+	path, err := se.serverSocket()
+	if err != nil {
+		warn("running the command without the server:", err)
+		return 0, false
+	}
+	se.countRun()
+
+	// the server may stop when idle between our dialing and our request
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, err := dialServer(path)
+		if err != nil {
+			debug("starting the server, none listening on", path+":", err)
+			err = startServer(path)
+			if err == nil {
+				conn, err = dialServer(path)
+			}
+			if err != nil {
+				warn("running the command without the server:", err)
+				return 0, false
+			}
+		}
+		code, started, err := se.forward(conn, entry)
+		conn.Close()
+		if err == nil {
+			return code, true
+		}
+		if started {
+			warn("lost the server while the command was running:", err)
+			return 1, true
+		}
+		debug("server went away before running the command:", err)
+	}
+	warn("running the command without the server, which keeps going away")
+	return 0, false
+}
+
+// startServer starts the server of the archive in the background, and waits
+// until it listens on the socket at path. Its messages go to a log file next
+// to the socket.
+func startServer(path string) error {
+	exePath, err := executable()
+	if err != nil {
+		return err
+	}
+	logPath := strings.TrimSuffix(path, ".sock") + ".log"
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exePath)
+	cmd.Env = append(os.Environ(), EnvServer+"="+serverDaemon)
+	cmd.Stdout = w
+	cmd.Stderr = logFile
+	detachProcess(cmd)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	cmd.Process.Release()
+
+	// the server closes the pipe once listening, or when failing
+	ready, _ := io.ReadAll(r)
+	if string(ready) != "ready\n" {
+		return fmt.Errorf("the server failed to start, see %s", logPath)
+	}
+	return nil
+}
+
+// forward hands the run to the server on conn, forwards it the signals
+// received, and returns the exit code of the command, and whether it started.
+func (se *selfExtractor) forward(conn *net.UnixConn, entry string) (int, bool, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, false, err
+	}
+	err = sendStdio(conn)
+	if err != nil {
+		return 0, false, err
+	}
+	enc := json.NewEncoder(conn)
+	err = enc.Encode(serverRequest{Args: se.args, Env: os.Environ(), Dir: dir, Entry: entry})
+	if err != nil {
+		return 0, false, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		for sig := range signals {
+			if s, ok := sig.(syscall.Signal); ok {
+				debug("forwarding signal", sig, "to the server")
+				enc.Encode(serverMessage{Signal: int(s)})
+			}
+		}
+	}()
+
+	started := false
+	dec := json.NewDecoder(conn)
+	for {
+		var msg serverMessage
+		err = dec.Decode(&msg)
+		if err != nil {
+			return 0, started, err
+		}
+		if msg.Error != "" {
+			warn(msg.Error)
+		}
+		if msg.Started {
+			started = true
+		}
+		if msg.Exit != nil {
+			return *msg.Exit, true, nil
+		}
+	}
+}
+
+// serve runs the server of the archive: it extracts the payload, tells the
+// run that started it it's ready, and runs the commands of the requests until
+// idle or stopped by a signal.
+func (se *selfExtractor) serve() int {
+	path, err := se.serverSocket()
+	if err != nil {
+		die("server:", err)
+	}
+	lock, err := lockPath(path)
+	if err != nil {
+		die("locking server socket:", err)
+	}
+	dieHooks = append(dieHooks, lock.unlock)
+	ready := os.Stdout
+	// the hooks and the messages of the stub mustn't write to the pipe
+	os.Stdout = os.Stderr
+
+	// another run may have started a server first
+	conn, err := dialServer(path)
+	if err == nil {
+		conn.Close()
+		lock.unlock()
+		debug("a server is already listening on", path)
+		fmt.Fprintln(ready, "ready")
+		return 0
+	}
+	os.Remove(path)
+
+	unlock := se.lockExtractDir()
+	se.prepareExtractDir()
+	se.extract()
+	unlock()
+	if !se.skipExtract {
+		code := se.runExtractHooks()
+		if code != 0 {
+			se.cleanup()
+			return code
+		}
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		se.cleanupAndDie("listening on server socket:", err)
+	}
+	lock.unlock()
+	debug("server listening on", path)
+	fmt.Fprintln(ready, "ready")
+	ready.Close()
+
+	se.serveRequests(l)
+	se.cleanup()
+	reportWarnings()
+	return 0
+}
+
+// serveRequests runs the commands of the requests accepted on l, until idle
+// or stopped by a signal, and waits for the commands still running.
+func (se *selfExtractor) serveRequests(l *net.UnixListener) {
+	defer l.Close()
+	stopping := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		debug("server got signal", sig, "stopping")
+		close(stopping)
+		l.Close()
+	}()
+
+	idle := serverIdleTimeout()
+	var mu sync.Mutex
+	var running sync.WaitGroup
+	active := 0
+	served := 0
+	for {
+		l.SetDeadline(clock.Now().Add(idle))
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			mu.Lock()
+			busy := active > 0
+			mu.Unlock()
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if busy {
+					continue
+				}
+				debug("server idle for", idle, "stopping")
+			} else {
+				debug("server stopped accepting requests:", err)
+			}
+			break
+		}
+		first := served == 0 && !se.skipExtract
+		served++
+		mu.Lock()
+		active++
+		mu.Unlock()
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			se.handleRequest(conn, first, stopping)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+	}
+	running.Wait()
+}
+
+// handleRequest runs the command of the request on conn with the standard
+// streams, arguments and environment of the run that sent it, and sends it
+// its exit code.
+func (se *selfExtractor) handleRequest(conn *net.UnixConn, first bool, stopping <-chan struct{}) {
+	defer conn.Close()
+	stdio, err := receiveStdio(conn)
+	if err != nil {
+		debug("server: receiving standard streams:", err)
+		return
+	}
+	defer func() {
+		for _, f := range stdio {
+			f.Close()
+		}
+	}()
+	dec := json.NewDecoder(conn)
+	var req serverRequest
+	err = dec.Decode(&req)
+	if err != nil {
+		debug("server: reading request:", err)
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+	exit := func(code int, err error) {
+		msg := serverMessage{Exit: &code}
+		if err != nil {
+			msg.Error = err.Error()
+		}
+		enc.Encode(msg)
+	}
+	args, what, err := se.serverCommand(req.Entry)
+	if err != nil {
+		exit(1, err)
+		return
+	}
+	if len(args) == 0 {
+		debug("nothing to run")
+		exit(0, nil)
+		return
+	}
+
+	cmd := exec.Command(args[0], append(args[1:], req.Args...)...)
+	env := req.Env
+	if se.settings.ScrubEnv {
+		env = se.scrubEnv(env)
+	}
+	cmd.Env = mergeEnv(env, append(se.injectedEnv(), EnvDir+"="+se.extractDir, EnvFirstRun+"="+strconv.FormatBool(first)))
+	cmd.Dir = req.Dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdio[0], stdio[1], stdio[2]
+	se.recordAudit(cmd.Args)
+	err = cmd.Start()
+	if err != nil {
+		exit(1, fmt.Errorf("%s failed to start: %w", what, err))
+		return
+	}
+	enc.Encode(serverMessage{Started: true})
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			var msg serverMessage
+			err := dec.Decode(&msg)
+			if err != nil {
+				// the run was killed, the command goes with it
+				select {
+				case <-done:
+				default:
+					cmd.Process.Signal(os.Interrupt)
+				}
+				return
+			}
+			if msg.Signal != 0 {
+				cmd.Process.Signal(syscall.Signal(msg.Signal))
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-stopping:
+			cmd.Process.Signal(os.Interrupt)
+		case <-done:
+		}
+	}()
+	code := commandExit(cmd.Wait(), what)
+	close(done)
+	exit(code, nil)
+}
+
+// serverCommand returns the command line the server runs for the entrypoint
+// entry, if not empty, without the arguments of the request. It is found
+// like startup does, except that the server can't run a compose file, and
+// returns no command line if there is nothing to run.
+func (se *selfExtractor) serverCommand(entry string) ([]string, string, error) {
+	var cmdline, what string
+	if entry != "" {
+		cmdline, what = se.settings.Entries[entry], "entrypoint "+entry
+	} else if _, err := os.Stat(filepath.Join(se.extractDir, composeFileName)); err == nil {
+		return nil, "", errors.New("the server can't run the commands of " + composeFileName)
+	} else if data, err := os.ReadFile(filepath.Join(se.extractDir, payloadFileName(EnvCmdline, "selfextract_cmdline"))); err == nil {
+		cmdline, what = string(data), "cmdline"
+	} else if se.settings.Cmd != "" {
+		cmdline, what = se.settings.Cmd, "command of the archive"
+	} else {
+		startupPath := filepath.Join(se.extractDir, payloadFileName(EnvStartup, "selfextract_startup"))
+		if _, err := os.Stat(startupPath); err != nil {
+			return nil, "", nil
+		}
+		return []string{startupPath}, "startup script", nil
+	}
+	args, err := se.splitCmdline(cmdline)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing %s: %w", what, err)
+	}
+	if len(args) == 0 {
+		return nil, "", errors.New(what + " is empty")
+	}
+	return args, what, nil
+}
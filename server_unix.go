@@ -0,0 +1,89 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// serverSupported tells whether archives can run their command through a
+// server, which needs passing file descriptors over unix sockets.
+const serverSupported = true
+
+// serverDir returns the directory of the sockets of the servers of the user,
+// in XDG_RUNTIME_DIR, or in the temporary dir otherwise. It must only be
+// accessible to the user, who could otherwise run commands as another.
+func serverDir() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" && filepath.IsAbs(dir) {
+		dir = filepath.Join(dir, "selfextract")
+	} else {
+		dir = filepath.Join(os.TempDir(), "selfextract-"+strconv.Itoa(os.Getuid()))
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(st.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s must be a directory only accessible to its owner", dir)
+	}
+	return dir, nil
+}
+
+// sendStdio sends the standard streams of the stub to the server.
+func sendStdio(conn *net.UnixConn) error {
+	rights := syscall.UnixRights(int(os.Stdin.Fd()), int(os.Stdout.Fd()), int(os.Stderr.Fd()))
+	_, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil)
+	return err
+}
+
+// receiveStdio receives the standard streams sent with sendStdio.
+func receiveStdio(conn *net.UnixConn) ([]*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	var files []*os.File
+	for _, fd := range fds {
+		// the commands run for other requests mustn't inherit them
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "stdio"))
+	}
+	if len(files) != 3 {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, fmt.Errorf("expected 3 standard streams, got %d", len(files))
+	}
+	return files, nil
+}
+
+// detachProcess makes the server outlive the run starting it, and the
+// terminal it runs in.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
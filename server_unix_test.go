@@ -0,0 +1,252 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socketPair returns both ends of a connected unix socket.
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+// pipeStdio replaces the standard streams with pipes for the duration of the
+// test, and returns the ends reading the output and writing the input.
+func pipeStdio(t *testing.T) (stdin, stdout, stderr *os.File) {
+	t.Helper()
+	var ends [3]*os.File
+	prev := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for i, std := range []**os.File{&os.Stdin, &os.Stdout, &os.Stderr} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			*std, ends[i] = r, w
+		} else {
+			*std, ends[i] = w, r
+		}
+		t.Cleanup(func() {
+			r.Close()
+			w.Close()
+		})
+	}
+	t.Cleanup(func() { os.Stdin, os.Stdout, os.Stderr = prev[0], prev[1], prev[2] })
+	return ends[0], ends[1], ends[2]
+}
+
+func TestSendReceiveStdio(t *testing.T) {
+	client, server := socketPair(t)
+	stdin, stdout, stderr := pipeStdio(t)
+	err := sendStdio(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := receiveStdio(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	stdin.Write([]byte("in\n"))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(files[0], buf); err != nil || string(buf) != "in\n" {
+		t.Errorf("read %q from stdin: %v", buf, err)
+	}
+	for i, r := range []*os.File{stdout, stderr} {
+		files[i+1].Write([]byte("out"))
+		if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "out" {
+			t.Errorf("read %q from stream %d: %v", buf, i+1, err)
+		}
+	}
+}
+
+func TestReceiveStdioMissing(t *testing.T) {
+	client, server := socketPair(t)
+	_, err := client.Write([]byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiveStdio(server)
+	if err == nil || !strings.Contains(err.Error(), "expected 3 standard streams, got 0") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// serverExtractor returns an extractor whose extraction dir has a startup
+// script running script, to serve requests.
+func serverExtractor(t *testing.T, script string) *selfExtractor {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "selfextract_startup"), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &selfExtractor{extractDir: dir}
+}
+
+func TestForwardToServer(t *testing.T) {
+	server := serverExtractor(t, `echo "args: $*"; echo "first: $`+EnvFirstRun+`"; exit 3`)
+	clientConn, serverConn := socketPair(t)
+	_, stdout, _ := pipeStdio(t)
+
+	done := make(chan struct{})
+	go func() {
+		server.handleRequest(serverConn, true, nil)
+		close(done)
+	}()
+	client := &selfExtractor{args: []string{"a", "b c"}}
+	code, started, err := client.forward(clientConn, "")
+	if err != nil || !started || code != 3 {
+		t.Errorf("got exit code %d, started: %v: %v", code, started, err)
+	}
+	<-done
+
+	os.Stdout.Close()
+	out, _ := io.ReadAll(stdout)
+	if want := "args: a b c\nfirst: true\n"; string(out) != want {
+		t.Errorf("got output %q, want %q", out, want)
+	}
+}
+
+func TestForwardToServerUnknownEntry(t *testing.T) {
+	server := serverExtractor(t, "exit 0")
+	clientConn, serverConn := socketPair(t)
+	pipeStdio(t)
+
+	go server.handleRequest(serverConn, false, nil)
+	code, _, err := (&selfExtractor{}).forward(clientConn, "nope")
+	if err != nil || code != 1 {
+		t.Errorf("got exit code %d: %v", code, err)
+	}
+}
+
+// startRequest sends a request to the server on conn as a run would, and
+// waits for its command to start.
+func startRequest(t *testing.T, conn *net.UnixConn) (*json.Encoder, *json.Decoder) {
+	t.Helper()
+	err := sendStdio(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	err = enc.Encode(serverRequest{Env: os.Environ(), Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg serverMessage
+	err = dec.Decode(&msg)
+	if err != nil || !msg.Started {
+		t.Fatalf("got message %+v: %v", msg, err)
+	}
+	return enc, dec
+}
+
+func TestHandleRequestSignal(t *testing.T) {
+	server := serverExtractor(t, "exec sleep 60")
+	clientConn, serverConn := socketPair(t)
+	pipeStdio(t)
+
+	go server.handleRequest(serverConn, false, nil)
+	enc, dec := startRequest(t, clientConn)
+	err := enc.Encode(serverMessage{Signal: int(syscall.SIGTERM)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg serverMessage
+	err = dec.Decode(&msg)
+	if err != nil || msg.Exit == nil || *msg.Exit != 128+int(syscall.SIGTERM) {
+		t.Errorf("got message %+v: %v", msg, err)
+	}
+}
+
+func TestHandleRequestClientGone(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(conn *net.UnixConn, stopping chan struct{})
+	}{
+		{"client closed", func(conn *net.UnixConn, stopping chan struct{}) { conn.Close() }},
+		{"server stopping", func(conn *net.UnixConn, stopping chan struct{}) { close(stopping) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := serverExtractor(t, "exec sleep 60")
+			clientConn, serverConn := socketPair(t)
+			pipeStdio(t)
+
+			stopping := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				server.handleRequest(serverConn, false, stopping)
+				close(done)
+			}()
+			startRequest(t, clientConn)
+			tc.stop(clientConn, stopping)
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the command still runs")
+			}
+		})
+	}
+}
+
+func TestServerSocket(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	t.Setenv(EnvDir, "")
+	socket := func(key string, blocks ...trailingBlock) string {
+		se := &selfExtractor{key: []byte(key), blocks: blocks}
+		path, err := se.serverSocket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	settings := trailingBlock{blockSettings, []byte(`{"cmd":"a"}`)}
+	path := socket("key", settings)
+	if socket("key", settings, trailingBlock{blockHelp, []byte("help")}) != path {
+		t.Error("other blocks change the socket")
+	}
+	for name, other := range map[string]string{
+		"key":         socket("other", settings),
+		"settings":    socket("key", trailingBlock{blockSettings, []byte(`{"cmd":"b"}`)}),
+		"no settings": socket("key"),
+		"stub":        socket("key", settings, trailingBlock{blockBuildInfo, []byte("v2")}),
+	} {
+		if other == path {
+			t.Errorf("another %s shares the socket", name)
+		}
+	}
+	t.Setenv(EnvDir, "/other")
+	if socket("key", settings) == path {
+		t.Error("another extraction dir shares the socket")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// serverSupported tells whether archives can run their command through a
+// server, which Windows can't do for lack of file descriptor passing.
+const serverSupported = false
+
+var errNoServer = errors.New("the server isn't supported on Windows")
+
+func serverDir() (string, error) {
+	return "", errNoServer
+}
+
+func sendStdio(conn *net.UnixConn) error {
+	return errNoServer
+}
+
+func receiveStdio(conn *net.UnixConn) ([]*os.File, error) {
+	return nil, errNoServer
+}
+
+func detachProcess(cmd *exec.Cmd) {}
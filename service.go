@@ -0,0 +1,115 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdUnitTemplate is the unit written by installService. The service uses
+// a persistent extraction dir so that restarts reuse the extracted files, and
+// stops with SIGINT so that the stub's grace timeout applies.
+const systemdUnitTemplate = `[Unit]
+Description=%s (selfextract archive)
+After=network.target
+
+[Service]
+Type=simple
+ExecStart=%s
+%sKillSignal=SIGINT
+TimeoutStopSec=%d
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// installService writes a systemd unit running the archive with the given
+// arguments, then enables it.
+func installService(name string, args []string, settings archiveSettings) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		die("invalid service name:", name)
+	}
+
+	exePath, err := executable()
+	if err != nil {
+		die("getting path of the archive:", err)
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		die("getting absolute path of the archive:", err)
+	}
+
+	extractDir := os.Getenv(EnvDir)
+	if extractDir == "" {
+		extractDir = filepath.Join("/var/lib", name)
+	}
+	err = settings.checkExtractDir(extractDir)
+	if err != nil {
+		die("extraction dir of the service:", err)
+	}
+	var envLines strings.Builder
+	fmt.Fprintf(&envLines, "Environment=%s\n", systemdQuote(EnvDir+"="+extractDir))
+	// forward the settings of the installing environment to the service
+	for _, k := range []string{EnvVerbose, EnvStartup, EnvCmdline, EnvGraceTimeout} {
+		if v := os.Getenv(k); v != "" {
+			fmt.Fprintf(&envLines, "Environment=%s\n", systemdQuote(k+"="+v))
+		}
+	}
+
+	execStart := systemdQuote(exePath)
+	for _, arg := range args {
+		execStart += " " + systemdQuote(arg)
+	}
+
+	// leave systemd some time to stop the service after the grace timeout
+	stopTimeout := int(graceTimeout().Seconds()) + 10
+
+	unitPath := filepath.Join(systemdUnitDir, name+".service")
+	unit := fmt.Sprintf(systemdUnitTemplate, name, execStart, envLines.String(), stopTimeout)
+	err = os.WriteFile(unitPath, []byte(unit), 0644)
+	if err != nil {
+		die("writing systemd unit:", err)
+	}
+	debug("wrote systemd unit", unitPath)
+
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", name + ".service"}} {
+		cmd := exec.Command("systemctl", args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			die("running systemctl", args[0]+":", err)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "installed and enabled", unitPath)
+}
+
+func installTask(name string, args []string) {
+	die("scheduled tasks are only supported on Windows, use --selfextract-install-service instead")
+}
+
+// isService reports whether the stub is run by a service manager that needs to
+// be talked to. systemd only needs the process to run in the foreground.
+func isService() bool {
+	return false
+}
+
+func runService(se *selfExtractor) int {
+	return se.run()
+}
+
+// systemdQuote quotes a word for use in a unit file, escaping the characters
+// systemd would otherwise expand.
+func systemdQuote(s string) string {
+	// line breaks would end the setting, they're written as C escapes
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$", "\n", `\n`, "\r", `\r`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func archivePath() string {
+	exePath, err := executable()
+	if err != nil {
+		die("getting path of the archive:", err)
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		die("getting absolute path of the archive:", err)
+	}
+	return exePath
+}
+
+func checkServiceName(name string) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		die("invalid service name:", name)
+	}
+}
+
+// installService registers the archive as an automatically started Windows
+// service, restarted on failure and using a persistent extraction dir.
+func installService(name string, args []string, settings archiveSettings) {
+	checkServiceName(name)
+	exePath := archivePath()
+
+	extractDir := os.Getenv(EnvDir)
+	if extractDir == "" {
+		extractDir = filepath.Join(os.Getenv("ProgramData"), name)
+	}
+	err := settings.checkExtractDir(extractDir)
+	if err != nil {
+		die("extraction dir of the service:", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		die("connecting to the service manager:", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(name, exePath, mgr.Config{
+		DisplayName: name,
+		Description: name + " (selfextract archive)",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		die("creating service:", err)
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		die("setting service recovery actions:", err)
+	}
+
+	env := []string{EnvDir + "=" + extractDir}
+	// forward the settings of the installing environment to the service
+	for _, k := range []string{EnvVerbose, EnvStartup, EnvCmdline, EnvGraceTimeout} {
+		if v := os.Getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	// the service manager reads the environment of a service from its
+	// registry key
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.SET_VALUE)
+	if err != nil {
+		die("opening service registry key:", err)
+	}
+	defer k.Close()
+	err = k.SetStringsValue("Environment", env)
+	if err != nil {
+		die("setting service environment:", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "installed service", name)
+}
+
+// maxTaskRunLength is the maximum length of the command of a scheduled task.
+const maxTaskRunLength = 261
+
+// installTask registers the archive as a scheduled task run at system startup.
+// Scheduled tasks have no environment of their own, so the extraction dir must
+// be configured system-wide if a persistent one is wanted.
+func installTask(name string, args []string) {
+	checkServiceName(name)
+
+	taskRun := syscall.EscapeArg(archivePath())
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			die("scheduled tasks can't have arguments with line breaks:", strconv.Quote(arg))
+		}
+		taskRun += " " + syscall.EscapeArg(arg)
+	}
+	// schtasks rejects longer commands, rather than truncating them
+	if len(taskRun) > maxTaskRunLength {
+		die(fmt.Sprintf("command of the scheduled task is %d characters long, over the maximum of %d", len(taskRun), maxTaskRunLength))
+	}
+
+	cmd := exec.Command("schtasks", "/Create", "/F", "/TN", name, "/TR", taskRun, "/SC", "ONSTART", "/RU", "SYSTEM")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		die("running schtasks:", err)
+	}
+}
+
+// isService reports whether the stub was started by the Windows service
+// manager.
+func isService() bool {
+	ok, err := svc.IsWindowsService()
+	if err != nil {
+		die("detecting whether running as a service:", err)
+	}
+	return ok
+}
+
+// serviceHandler answers the service manager, forwarding stop requests to the
+// payload command.
+type serviceHandler struct {
+	se   *selfExtractor
+	exit int
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+
+	done := make(chan int)
+	go func() {
+		done <- h.se.run()
+	}()
+
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case h.exit = <-done:
+			s <- svc.Status{State: svc.Stopped}
+			return h.exit != 0, uint32(h.exit)
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				debug("service stop requested")
+				s <- svc.Status{State: svc.StopPending, WaitHint: uint32((graceTimeout() + 5*time.Second).Milliseconds())}
+				h.se.stopChildren()
+			}
+		}
+	}
+}
+
+// runService runs the archive under the control of the service manager.
+func runService(se *selfExtractor) int {
+	h := serviceHandler{se: se}
+	err := svc.Run("", &h)
+	if err != nil {
+		die("running service:", err)
+	}
+	return h.exit
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// archiveSettings are chosen when creating an archive, and change how the stub
+// runs it. They are recorded in a trailing block, as JSON.
+type archiveSettings struct {
+	// remove the SELFEXTRACT_* variables from the environment of the
+	// commands run, except those of KeepEnv and the ones set for them
+	ScrubEnv bool     `json:"scrub_env,omitempty"`
+	KeepEnv  []string `json:"keep_env,omitempty"`
+
+	// prefix of the environment variables, instead of SELFEXTRACT_
+	EnvPrefix string `json:"env_prefix,omitempty"`
+
+	// command line run after extraction, unless the payload has a cmdline
+	// file
+	Cmd string `json:"cmd,omitempty"`
+	// command lines run instead, by name, when chosen with SELFEXTRACT_ENTRY
+	// or by the name the archive is run as
+	Entries map[string]string `json:"entries,omitempty"`
+	// NAME=VALUE variables set in the environment of the commands, in
+	// which __EXTRACT_DIR__ is replaced by the extraction dir
+	Env []string `json:"env,omitempty"`
+	// replace the stub by the command instead of running it as a child
+	Exec bool `json:"exec,omitempty"`
+	// run the command through a server extracting the payload once for the
+	// runs of the archive
+	Server bool `json:"server,omitempty"`
+
+	// refuse extraction dirs set with SELFEXTRACT_DIR, or only accept the
+	// ones inside AllowedDirs, if any
+	NoDirOverride bool     `json:"no_dir_override,omitempty"`
+	AllowedDirs   []string `json:"allowed_dirs,omitempty"`
+
+	// refuse to run from this time
+	Expires *time.Time `json:"expires,omitempty"`
+	// refuse to run when the key of the archive is in the list at
+	// RevocationURL, signed with the ed25519 RevocationKey, and when the
+	// list can't be checked if RevocationRequired, including when it is
+	// older than RevocationMaxAge. The list is checked again after
+	// RevocationInterval, or at each run if zero.
+	RevocationURL      string        `json:"revocation_url,omitempty"`
+	RevocationKey      []byte        `json:"revocation_key,omitempty"`
+	RevocationRequired bool          `json:"revocation_required,omitempty"`
+	RevocationMaxAge   time.Duration `json:"revocation_max_age,omitempty"`
+	RevocationInterval time.Duration `json:"revocation_interval,omitempty"`
+
+	// give the extracted files the owners and groups recorded in the
+	// archive, when running as root
+	PreserveOwner bool `json:"preserve_owner,omitempty"`
+
+	// count the runs of the archive in the state dir, under this name shared
+	// by the versions of the product, and tell them to the commands
+	CountRuns string `json:"count_runs,omitempty"`
+}
+
+// block returns the trailing block recording the settings, unless they are
+// all defaults.
+func (s archiveSettings) block() (trailingBlock, bool) {
+	if reflect.DeepEqual(s, archiveSettings{}) {
+		return trailingBlock{}, false
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		die("encoding archive settings:", err)
+	}
+	return trailingBlock{typ: blockSettings, data: data}, true
+}
+
+// loadSettings returns the settings recorded in the archive, if any.
+func loadSettings(blocks []trailingBlock) archiveSettings {
+	var s archiveSettings
+	for _, b := range blocks {
+		if b.typ != blockSettings {
+			continue
+		}
+		err := json.Unmarshal(b.data, &s)
+		if err != nil {
+			warn("ignoring invalid archive settings:", err)
+			return archiveSettings{}
+		}
+	}
+	return s
+}
+
+// childEnv returns the environment of the commands run, or nil for them to
+// inherit the one of the stub.
+func (se *selfExtractor) childEnv() []string {
+	injected := se.injectedEnv()
+	if !se.settings.ScrubEnv && len(injected) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	if se.settings.ScrubEnv {
+		env = se.scrubEnv(env)
+	}
+	return mergeEnv(env, injected)
+}
+
+// scrubEnv removes the SELFEXTRACT_* variables from environ, except the ones
+// kept for the commands.
+func (se *selfExtractor) scrubEnv(environ []string) []string {
+	// the variables set for the commands are kept
+	keep := map[string]bool{EnvDir: true, EnvFirstRun: true, EnvRunCount: true, EnvLastRun: true, EnvExitCode: true}
+	for _, name := range se.settings.KeepEnv {
+		keep[name] = true
+	}
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, envPrefix) && !keep[name] {
+			debug("removing", name, "from the environment of the commands")
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the size of the zero blocks left as holes when extracting
+// sparse files, which is the block size of most filesystems.
+const sparseBlockSize = 4096
+
+// isSparse reports whether hdr is the header of a sparse file, in one of the
+// GNU formats.
+func isSparse(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeGNUSparse || hdr.PAXRecords["GNU.sparse.major"] != "" || hdr.PAXRecords["GNU.sparse.numblocks"] != ""
+}
+
+// writeSparse writes the size bytes of r to f, seeking over the blocks of
+// zeros instead of writing them, so that they become holes on the filesystems
+// supporting them.
+func writeSparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 16*sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	var written int64
+	for written < size {
+		n, err := io.ReadFull(r, buf[:min64(int64(len(buf)), size-written)])
+		if err != nil {
+			return err
+		}
+		for chunk := buf[:n]; len(chunk) > 0; {
+			m := len(chunk)
+			if m > sparseBlockSize {
+				m = sparseBlockSize
+			}
+			if bytes.Equal(chunk[:m], zeros[:m]) {
+				_, err = f.Seek(int64(m), io.SeekCurrent)
+			} else {
+				_, err = f.Write(chunk[:m])
+			}
+			if err != nil {
+				return err
+			}
+			chunk = chunk[m:]
+		}
+		written += int64(n)
+	}
+	// a hole at the end of the file is only there once the size is set
+	return f.Truncate(size)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
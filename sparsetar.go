@@ -0,0 +1,164 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// region is a part of a file holding data, as opposed to a hole.
+type region struct {
+	off, len int64
+}
+
+const tarBlockSize = 512
+
+// writeSparseEntry writes the sparse file name to the tar written by tw to w,
+// in the PAX format 1.0 of GNU tar, with only the data of regions. The tar
+// writer of the standard library can't write sparse files, so the entry is
+// encoded here and written between the entries of tw.
+func writeSparseEntry(tw *tar.Writer, w io.Writer, hdr *tar.Header, name string, regions []region) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a hole at the end is marked by an empty region at the end, without
+	// which readers would truncate the file
+	if n := len(regions); n == 0 || regions[n-1].off+regions[n-1].len < hdr.Size {
+		regions = append(regions, region{hdr.Size, 0})
+	}
+	// the sparse map is at the start of the data of the entry
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	physical := int64(0)
+	for _, r := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", r.off, r.len)
+		physical += r.len
+	}
+	padBlock(&sparseMap)
+	physical += int64(sparseMap.Len())
+
+	records := [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", hdr.Name},
+		{"GNU.sparse.realsize", strconv.FormatInt(hdr.Size, 10)},
+	}
+	// the values not fitting in the ustar header are PAX records instead
+	uid, gid, size, mtime := hdr.Uid, hdr.Gid, physical, hdr.ModTime.Unix()
+	if uid < 0 || uid >= 1<<21 {
+		records = append(records, [2]string{"uid", strconv.Itoa(uid)})
+		uid = 0
+	}
+	if gid < 0 || gid >= 1<<21 {
+		records = append(records, [2]string{"gid", strconv.Itoa(gid)})
+		gid = 0
+	}
+	if size >= 1<<33 {
+		records = append(records, [2]string{"size", strconv.FormatInt(size, 10)})
+		size = 0
+	}
+	if mtime < 0 || mtime >= 1<<33 {
+		records = append(records, [2]string{"mtime", strconv.FormatInt(mtime, 10)})
+		mtime = 0
+	}
+	// e.g. the extended attributes
+	var keys []string
+	for k := range hdr.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		records = append(records, [2]string{k, hdr.PAXRecords[k]})
+	}
+	var pax bytes.Buffer
+	for _, r := range records {
+		pax.WriteString(paxRecord(r[0], r[1]))
+	}
+
+	// complete the previous entry before writing this one
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+	base := path.Base(hdr.Name)
+	var buf bytes.Buffer
+	buf.Write(ustarHeader(tar.TypeXHeader, "PaxHeaders.0/"+base, int64(pax.Len()), 0644, 0, 0, mtime))
+	padBlock(&pax)
+	buf.Write(pax.Bytes())
+	buf.Write(ustarHeader(tar.TypeReg, "GNUSparseFile.0/"+base, size, hdr.Mode, uid, gid, mtime))
+	buf.Write(sparseMap.Bytes())
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for _, r := range regions {
+		_, err = io.Copy(w, io.NewSectionReader(f, r.off, r.len))
+		if err != nil {
+			return err
+		}
+	}
+	if pad := physical % tarBlockSize; pad != 0 {
+		_, err = w.Write(make([]byte, tarBlockSize-pad))
+	}
+	return err
+}
+
+// paxRecord encodes a PAX record, prefixed by its own length.
+func paxRecord(key, value string) string {
+	rec := " " + key + "=" + value + "\n"
+	size := len(rec)
+	for size != len(strconv.Itoa(size))+len(rec) {
+		size = len(strconv.Itoa(size)) + len(rec)
+	}
+	return strconv.Itoa(size) + rec
+}
+
+// padBlock pads b with zeros to a multiple of the tar block size.
+func padBlock(b *bytes.Buffer) {
+	if pad := b.Len() % tarBlockSize; pad != 0 {
+		b.Write(make([]byte, tarBlockSize-pad))
+	}
+}
+
+// ustarHeader encodes a tar header block in the ustar format. Names are
+// truncated to fit, which is only used for names that readers replace.
+func ustarHeader(typeflag byte, name string, size, mode int64, uid, gid int, mtime int64) []byte {
+	blk := make([]byte, tarBlockSize)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(blk[0:100], name)
+	putOctal(blk[100:108], mode&07777)
+	putOctal(blk[108:116], int64(uid))
+	putOctal(blk[116:124], int64(gid))
+	putOctal(blk[124:136], size)
+	putOctal(blk[136:148], mtime)
+	blk[156] = typeflag
+	copy(blk[257:263], "ustar\x00")
+	copy(blk[263:265], "00")
+
+	// the checksum is computed with its own field made of spaces
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+// putOctal writes v in the numeric field b, as NUL-terminated octal.
+func putOctal(b []byte, v int64) {
+	copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, v))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const specialBits = fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// tarMode returns the permission bits of a file as tar records them, with the
+// setuid, setgid and sticky bits at their Unix values.
+func tarMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// fileMode returns the mode to give to an extracted file. As the setuid and
+// setgid bits give privileges to whoever runs the files, they are stripped
+// with a warning, like the sticky bit, unless asked to preserve them as root.
+func (se *selfExtractor) fileMode(name string, hdr *tar.Header) os.FileMode {
+	mode := hdr.FileInfo().Mode()
+	special := mode & specialBits
+	if special == 0 || se.preserveSpecialBits {
+		return mode.Perm() | special
+	}
+	var bits []string
+	for i, bit := range []fs.FileMode{fs.ModeSetuid, fs.ModeSetgid, fs.ModeSticky} {
+		if special&bit != 0 {
+			bits = append(bits, []string{"setuid", "setgid", "sticky"}[i])
+		}
+	}
+	warn("not preserving", strings.Join(bits, " and "), "bits of", name+", set", EnvPreserveSpecialBits, "as root to keep them")
+	return mode.Perm()
+}
+
+// parseSpecialBitsPolicy reads whether the setuid, setgid and sticky bits of
+// the extracted files are preserved.
+func (se *selfExtractor) parseSpecialBitsPolicy() {
+	if !isTruthy(os.Getenv(EnvPreserveSpecialBits)) {
+		return
+	}
+	if os.Geteuid() != 0 {
+		warn("not running as root, ignoring", EnvPreserveSpecialBits)
+		return
+	}
+	se.preserveSpecialBits = true
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractSetuidWithOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("owners and special bits are only restored as root")
+	}
+	t.Setenv(EnvPreserveOwner, "1")
+	t.Setenv(EnvPreserveSpecialBits, "1")
+
+	dir := t.TempDir()
+	// pooled and written inline
+	fatal := extractTar(t, dir, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "small", Size: 10, Mode: 04755, Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeReg, Name: "big", Size: pooledFileMax + 1, Mode: 06755, Uid: 1000, Gid: 1000},
+	})
+	if fatal != "" {
+		t.Fatal(fatal)
+	}
+	for name, want := range map[string]os.FileMode{
+		"small": 0755 | os.ModeSetuid,
+		"big":   0755 | os.ModeSetuid | os.ModeSetgid,
+	} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode(), want)
+		}
+		if st := info.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+			t.Errorf("%s is owned by %d:%d, want 1000:1000", name, st.Uid, st.Gid)
+		}
+	}
+}
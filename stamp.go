@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const stampMarkerLen = 24
+
+// stamp is a reserved location in the stub, that create patches with the
+// offset of the boundary in the archive, so that the stub doesn't have to
+// scan itself to find it. It starts with a marker used to locate it in the
+// executable, and ends with the offset (little-endian), which stays zero in
+// the creator and in hand-assembled archives.
+var stamp = [stampMarkerLen + 8]byte{
+	'S', 'E', 'L', 'F', 'E', 'X', 'T', 'R', 'A', 'C', 'T', '-',
+	'S', 'T', 'A', 'M', 'P', '-', 0xf0, 0x9f, 0x93, 0xa6, 0x00, 0x01,
+}
+
+// stampedBoundary returns the boundary offset stamped in the stub, if any.
+func stampedBoundary() (int64, bool) {
+	off := binary.LittleEndian.Uint64(stamp[stampMarkerLen:])
+	return int64(off), off != 0
+}
+
+// checkBoundary reports whether the boundary is at the given offset of r.
+func checkBoundary(r io.ReadSeeker, off int64) bool {
+	boundary := generateBoundary()
+	buf := make([]byte, len(boundary))
+	_, err := r.Seek(off, io.SeekStart)
+	if err != nil {
+		return false
+	}
+	_, err = io.ReadFull(r, buf)
+	return err == nil && bytes.Equal(buf, boundary)
+}
+
+// stampStub patches the boundary offset into a copy of the stub, which is
+// where the boundary will be written. It returns false if the stamp couldn't
+// be located unambiguously, or mustn't be patched.
+func stampStub(stub []byte) bool {
+	if isMachO(stub) {
+		return false
+	}
+	marker := stamp[:stampMarkerLen]
+	i := bytes.Index(stub, marker)
+	if i < 0 || bytes.Contains(stub[i+1:], marker) {
+		return false
+	}
+	binary.LittleEndian.PutUint64(stub[i+stampMarkerLen:], uint64(len(stub)))
+	return true
+}
+
+// isMachO reports whether the stub is a macOS executable. The Go linker signs
+// them, and macOS kills the executables whose code doesn't match their
+// signature anymore, as it would once stamped.
+func isMachO(stub []byte) bool {
+	if len(stub) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(stub) {
+	case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe, 0xcafebabe:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestStampStub(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		magic   []byte
+		stamped bool
+	}{
+		{"elf", []byte("\x7fELF"), true},
+		{"pe", []byte("MZ\x90\x00"), true},
+		{"mach-o 64-bit", []byte{0xcf, 0xfa, 0xed, 0xfe}, false},
+		{"mach-o 32-bit", []byte{0xce, 0xfa, 0xed, 0xfe}, false},
+		{"mach-o universal", []byte{0xca, 0xfe, 0xba, 0xbe}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := append(append(append([]byte(nil), tc.magic...), make([]byte, 100)...), stamp[:]...)
+			stub = append(stub, make([]byte, 100)...)
+			orig := append([]byte(nil), stub...)
+			if stampStub(stub) != tc.stamped {
+				t.Fatalf("stamped: %v, want %v", !tc.stamped, tc.stamped)
+			}
+			if !tc.stamped {
+				if !bytes.Equal(stub, orig) {
+					t.Error("stub modified without being stamped")
+				}
+				return
+			}
+			i := len(tc.magic) + 100 + stampMarkerLen
+			if off := binary.LittleEndian.Uint64(stub[i:]); off != uint64(len(stub)) {
+				t.Errorf("stamped offset %d, want %d", off, len(stub))
+			}
+		})
+	}
+}
+
+func TestStampStubAmbiguous(t *testing.T) {
+	stub := append(append([]byte("\x7fELF"), stamp[:]...), stamp[:]...)
+	if stampStub(stub) {
+		t.Error("stub with two stamps stamped")
+	}
+}
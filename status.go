@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// statusReport summarizes a run of the archive, so that wrappers can get its
+// results without scraping its output.
+type statusReport struct {
+	Archive   string        `json:"archive"`
+	Key       string        `json:"key"`
+	Dir       string        `json:"dir"`
+	Temporary bool          `json:"temporary"`
+	ExitCode  int           `json:"exit_code"`
+	Phases    []phaseTiming `json:"phases"`
+	Warnings  []string      `json:"warnings,omitempty"`
+	Errors    []string      `json:"errors,omitempty"`
+}
+
+// fatalError is the message of the fatal error the archive is exiting on.
+var fatalError string
+
+// writeStatus writes the summary of the run to the file set in the
+// environment, if any. It is called on exit, including fatal errors.
+func (se *selfExtractor) writeStatus(exitCode int) {
+	path := os.Getenv(EnvStatusFile)
+	if path == "" {
+		return
+	}
+
+	exePath, _ := executable()
+	report := statusReport{
+		Archive:   exePath,
+		Key:       hex.EncodeToString(se.key),
+		Dir:       se.extractDir,
+		Temporary: se.tempDir,
+		ExitCode:  exitCode,
+		Phases:    timings.list(),
+		Warnings:  warnings.list(),
+		Errors:    se.errors,
+	}
+	if fatalError != "" {
+		report.Errors = append(report.Errors, fatalError)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		warn("encoding status:", err)
+		return
+	}
+	err = os.WriteFile(path, append(data, '\n'), 0600)
+	if err != nil {
+		warn("writing status file:", err)
+	}
+}
+
+// addError records a non-fatal error for the status report.
+func (se *selfExtractor) addError(v ...interface{}) {
+	se.errors = append(se.errors, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
@@ -0,0 +1,51 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// legacyCapabilities are those of the stubs older than the marker.
+var legacyCapabilities = map[string]bool{"zstd": true}
+
+// stubCapabilities returns the capabilities of a stub, which are the legacy
+// ones when it has no marker.
+func stubCapabilities(stub []byte) map[string]bool {
+	marker := capabilities[:capabilitiesMarkerLen]
+	i := bytes.Index(stub, []byte(marker))
+	if i < 0 {
+		return legacyCapabilities
+	}
+	list := stub[i+len(marker):]
+	if end := bytes.IndexByte(list, 0); end >= 0 {
+		list = list[:end]
+	}
+	caps := make(map[string]bool)
+	for _, c := range strings.Split(string(list), ",") {
+		caps[c] = true
+	}
+	return caps
+}
+
+// adaptToStub makes the archive options fit what a stub can extract,
+// dropping the optional features it lacks, and fails when it lacks required
+// ones.
+func adaptToStub(opts *createOptions, caps map[string]bool) {
+	compression := string(opts.compression)
+	if compression == "" {
+		compression = defaultCompression
+	}
+	if !caps[compression] {
+		die("stub can't extract", compression, "payloads, use -z to pick another compression")
+	}
+	if opts.long != 0 && !caps["long"] {
+		warn("stub can't extract payloads compressed with -long, compressing without it")
+		opts.long = 0
+	}
+	if opts.passphrase != nil && !caps["encrypted"] {
+		die("stub can't extract encrypted payloads")
+	}
+	opts.noHardLinks = !caps["hardlink"]
+}
@@ -0,0 +1,15 @@
+//go:build stubonly
+
+package main
+
+import "io"
+
+// extraCodecCapabilities is empty, since the codecs other than zstd are left
+// out of these stubs.
+const extraCodecCapabilities = ""
+
+// runCreator fails, since stubs built with the stubonly tag, which are smaller,
+// only extract archives.
+func runCreator(self io.ReadSeeker) {
+	die("this executable is a stub without the creation code, it can only be used with rewrap -stub")
+}
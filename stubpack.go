@@ -0,0 +1,55 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/google/shlex"
+)
+
+// packStub shrinks the stub with an executable packer like UPX, which
+// decompresses the executable in memory when it starts, so that the stub
+// doesn't dominate the size of archives with small payloads. The command is
+// run with the path of a copy of the stub as last argument, and must pack it
+// in place, e.g. "upx --best --lzma".
+func packStub(stub []byte, command string) ([]byte, error) {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	f, err := os.CreateTemp("", "selfextract-stub")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(stub)
+	if err == nil {
+		err = f.Chmod(0755)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(args[0], append(args[1:], f.Name())...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	debug("packed stub from", len(stub), "to", len(packed), "bytes")
+	return packed, nil
+}
@@ -0,0 +1,210 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// importTar copies the entries of an existing tar into the payload written by
+// tarWrt to w. As the tar may come from a third party, it applies the same
+// kind of safety options as tar(1) does when extracting.
+func importTar(tarWrt *tar.Writer, w io.Writer, opts createOptions) []fileSize {
+	var in io.Reader = os.Stdin
+	switch {
+	case opts.tarInput != nil:
+		in = opts.tarInput
+	case opts.fromTar != "-":
+		f, err := os.Open(opts.fromTar)
+		if err != nil {
+			die("opening tar to import:", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if opts.tarInput == nil {
+		rdr, err := decompressImport(in)
+		if err != nil {
+			die("reading tar to import:", err)
+		}
+		defer rdr.Close()
+		in = rdr
+	}
+
+	var sizes []fileSize
+	// regular files imported, which hard links can point to
+	imported := make(map[string]bool)
+	tarRdr := tar.NewReader(in)
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			die("reading tar to import:", err)
+		}
+
+		name, ok := stripComponents(hdr.Name, opts.stripComponents)
+		if !ok {
+			continue
+		}
+		name = path.Clean(name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			die("unsafe path in tar to import:", hdr.Name)
+		}
+		if !matchFilters(name, opts.tarInclude, opts.tarExclude) {
+			debug("skipping filtered tar entry", name)
+			continue
+		}
+		if opts.replaced[name] {
+			debug("skipping replaced tar entry", name)
+			continue
+		}
+
+		sparse := isSparse(hdr)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			hdr.Typeflag = tar.TypeReg
+			sizes = append(sizes, fileSize{name, hdr.Size})
+			imported[name] = true
+		case tar.TypeLink:
+			if opts.noHardLinks {
+				die("stub can't extract hard links:", hdr.Name)
+			}
+			target, ok := stripComponents(hdr.Linkname, opts.stripComponents)
+			target = path.Clean(target)
+			if !ok || !imported[target] {
+				warn("skipping hard link to a file that isn't imported:", hdr.Name)
+				continue
+			}
+			hdr.Linkname = target
+		case tar.TypeDir, tar.TypeSymlink:
+		default:
+			warn("skipping tar entry of unsupported type", string(hdr.Typeflag)+":", hdr.Name)
+			continue
+		}
+
+		if opts.reproducible {
+			normalizeHeader(hdr, opts.sourceDate)
+		}
+		if opts.noSameOwner {
+			hdr.Uid, hdr.Gid = 0, 0
+			hdr.Uname, hdr.Gname = "", ""
+		}
+		if uid, ok := opts.ownerMap.lookup(hdr.Uid); ok {
+			hdr.Uid, hdr.Uname = uid, ""
+		}
+		if gid, ok := opts.groupMap.lookup(hdr.Gid); ok {
+			hdr.Gid, hdr.Gname = gid, ""
+		}
+		hdr.Name = name
+
+		debug("importing", name)
+		if sparse {
+			err = importSparse(tarWrt, w, hdr, tarRdr)
+			if err != nil {
+				die("importing sparse file:", name, err)
+			}
+			continue
+		}
+		err = tarWrt.WriteHeader(hdr)
+		if err != nil {
+			die("writing tar header of file:", name)
+		}
+		_, err = io.Copy(tarWrt, tarRdr)
+		if err != nil {
+			die("writing file to tar:", name)
+		}
+	}
+	return sizes
+}
+
+// importSparse imports a sparse file, whose holes are found again from the
+// blocks of zeros of its data, through a temporary file.
+func importSparse(tarWrt *tar.Writer, w io.Writer, hdr *tar.Header, r io.Reader) error {
+	tmp, err := os.CreateTemp("", "selfextract-sparse")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	err = writeSparse(tmp, r, hdr.Size)
+	if err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if regions, ok := dataRegions(tmp.Name(), info); ok {
+		return writeSparseEntry(tarWrt, w, hdr, tmp.Name(), regions)
+	}
+
+	// the temporary dir may not support holes
+	err = tarWrt.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWrt, tmp)
+	return err
+}
+
+// decompressImport decompresses a tar to import, so that compressed tarballs
+// of release pipelines can be imported as they are. They are recompressed
+// with the compression of the payload.
+func decompressImport(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(3)
+	if err == nil && string(head) == "BZh" {
+		debug("decompressing bzip2 tar to import")
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	}
+	// tarballs have no blocks recording their compression
+	return newDecompressor(br, nil)
+}
+
+// stripComponents removes the n first elements of a path, and reports whether
+// anything is left.
+func stripComponents(name string, n int) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	for i := 0; i < n; i++ {
+		slash := strings.IndexByte(name, '/')
+		if slash < 0 {
+			return "", false
+		}
+		name = name[slash+1:]
+	}
+	name = strings.TrimSuffix(name, "/")
+	return name, name != ""
+}
+
+// matchFilters reports whether a path is selected by the include and exclude
+// glob patterns. Patterns match either the whole path or its base name.
+func matchFilters(name string, include, exclude []string) bool {
+	if len(include) > 0 && !matchAny(name, include) {
+		return false
+	}
+	return !matchAny(name, exclude)
+}
+
+func matchAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseTiming is how long a phase of a run took.
+type phaseTiming struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// phaseTimings records the duration of each phase of a run, to track
+// performance regressions.
+type phaseTimings struct {
+	mu     sync.Mutex
+	phases []phaseTiming
+}
+
+var timings phaseTimings
+
+func (t *phaseTimings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	t.phases = append(t.phases, phaseTiming{name, d})
+	t.mu.Unlock()
+	debug(name, "completed in", d)
+}
+
+func (t *phaseTimings) list() []phaseTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]phaseTiming(nil), t.phases...)
+}
+
+func (t *phaseTimings) summary() string {
+	var parts []string
+	for _, p := range t.list() {
+		parts = append(parts, fmt.Sprintf("%s=%s", p.Name, p.Duration))
+	}
+	return strings.Join(parts, " ")
+}
+
+// timePhase starts timing a phase, which ends when the returned function is
+// called.
+func timePhase(name string) func() {
+	start := time.Now()
+	return func() {
+		timings.add(name, time.Since(start))
+	}
+}
+
+// timingReader accumulates the time spent reading from r.
+type timingReader struct {
+	r io.Reader
+	d *time.Duration
+}
+
+func (t timingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	*t.d += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tmpfilesDir = "/etc/tmpfiles.d"
+
+// excludeFromTmpCleanup writes a systemd-tmpfiles exclusion for a persistent
+// extraction dir under /tmp or /var/tmp, so that the periodic cleanup of these
+// directories doesn't remove it between runs, which would defeat its reuse.
+func (se *selfExtractor) excludeFromTmpCleanup() {
+	dir, err := filepath.Abs(se.extractDir)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(dir, "/tmp/") && !strings.HasPrefix(dir, "/var/tmp/") {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(dir))
+	path := filepath.Join(tmpfilesDir, "selfextract-"+hex.EncodeToString(sum[:8])+".conf")
+	quoted := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(dir) + `"`
+	conf := fmt.Sprintf("# written by selfextract, so that the extraction dir is kept\nx %s\n", quoted)
+	if data, err := os.ReadFile(path); err == nil && string(data) == conf {
+		return
+	}
+	err = os.WriteFile(path, []byte(conf), 0644)
+	if err != nil {
+		warn("cannot exclude", dir, "from the cleanup of temporary files, use a dir under /var/cache instead:", err)
+		return
+	}
+	debug("excluded extraction dir from the cleanup of temporary files in", path)
+}
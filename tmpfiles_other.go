@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// excludeFromTmpCleanup does nothing, as systemd-tmpfiles is Linux only.
+func (se *selfExtractor) excludeFromTmpCleanup() {}
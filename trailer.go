@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Data may follow the payload, in the form of trailing blocks. This lets other
+// tools (signing, packaging...) append their own data to an archive without
+// corrupting it. Each block is framed with a footer so that blocks can be
+// walked back from the end of the file:
+//
+//	data | type (uint32) | size of data (uint64) | blockMagic
+//
+// Integers are little-endian. Block types are assigned by the tools writing
+// them, and tools must keep the blocks of types they don't know intact when
+// rewriting an archive. Types starting with 0x5346 ("SF") are reserved for
+// selfextract.
+const blockMagic = "SFXBLOCK"
+
+const (
+	blockBuildInfo uint32 = 0x53460001 + iota
+	blockMessages
+	blockPayloadDigest
+	blockHelp
+	blockBoundary
+	blockSettings
+	blockPayloadSize
+	blockMetadata
+	blockKey
+	blockCompression
+)
+
+// ownBlock reports whether a block is written by selfextract itself, so that
+// it must be regenerated rather than kept when rewriting an archive.
+func ownBlock(b trailingBlock) bool {
+	return b.typ>>16 == 0x5346
+}
+
+const blockFooterSize = 4 + 8 + len(blockMagic)
+
+type trailingBlock struct {
+	typ  uint32
+	data []byte
+}
+
+// readTrailingBlocks reads the blocks found between start and end in r. It
+// fails if the data isn't made exclusively of well-formed blocks.
+func readTrailingBlocks(r io.ReadSeeker, start, end int64) ([]trailingBlock, error) {
+	var blocks []trailingBlock
+	footer := make([]byte, blockFooterSize)
+
+	for end > start {
+		if end-start < int64(blockFooterSize) {
+			return nil, fmt.Errorf("truncated block footer at offset %d", start)
+		}
+		_, err := r.Seek(end-int64(blockFooterSize), io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(r, footer)
+		if err != nil {
+			return nil, err
+		}
+		if string(footer[12:]) != blockMagic {
+			return nil, fmt.Errorf("no block magic at offset %d", end-int64(len(blockMagic)))
+		}
+
+		typ := binary.LittleEndian.Uint32(footer[0:4])
+		size := binary.LittleEndian.Uint64(footer[4:12])
+		dataEnd := end - int64(blockFooterSize)
+		if size > uint64(dataEnd-start) {
+			return nil, fmt.Errorf("block of %d bytes ending at offset %d overlaps the payload", size, end)
+		}
+
+		if uint64(int(size)) != size {
+			return nil, fmt.Errorf("block of %d bytes too big for this platform", size)
+		}
+		data := make([]byte, size)
+		_, err = r.Seek(dataEnd-int64(size), io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append([]trailingBlock{{typ, data}}, blocks...)
+		end = dataEnd - int64(size)
+	}
+
+	return blocks, nil
+}
+
+// maxLeadingBlocksSize bounds how much of the data after the payload is read
+// by readLeadingBlocks.
+const maxLeadingBlocksSize = 16 << 20 // 16 MB
+
+// readLeadingBlocks reads the well-formed blocks following each other from
+// start in r, stopping at the first data that isn't one, for archives which
+// have other data after their blocks, e.g. when concatenated with a file.
+func readLeadingBlocks(r io.ReadSeeker, start, end int64) []trailingBlock {
+	if end-start > maxLeadingBlocksSize {
+		end = start + maxLeadingBlocksSize
+	}
+	_, err := r.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil
+	}
+	data := make([]byte, end-start)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil
+	}
+
+	var blocks []trailingBlock
+	off, from := 0, 0 // start of the next block, and of the search of its footer
+	for {
+		i := bytes.Index(data[from:], []byte(blockMagic))
+		if i < 0 {
+			return blocks
+		}
+		magicOff := from + i
+		footerOff := magicOff - 12
+		from = magicOff + 1
+		if footerOff < off {
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[footerOff+4 : footerOff+12])
+		if size != uint64(footerOff-off) {
+			continue
+		}
+		typ := binary.LittleEndian.Uint32(data[footerOff : footerOff+4])
+		blocks = append(blocks, trailingBlock{typ, data[off:footerOff]})
+		off = magicOff + len(blockMagic)
+		from = off
+	}
+}
+
+// maxBoundaryBlockDistance is how many blocks are walked back from the end of
+// an archive to find its boundary block, so that files which merely end like
+// blocks aren't walked entirely.
+const maxBoundaryBlockDistance = 64
+
+// boundaryBlock records the offset of the boundary. It is the last block
+// written by create, so that the stub finds the payload by reading the end of
+// the archive instead of searching for the boundary, even when other tools
+// appended blocks after it.
+func boundaryBlock(off int64) trailingBlock {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(off))
+	return trailingBlock{typ: blockBoundary, data: data}
+}
+
+// trailerBoundary returns the boundary offset recorded in the blocks at the end
+// of r, walking them back from the end until the boundary block.
+func trailerBoundary(r io.ReadSeeker) (int64, bool) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	footer := make([]byte, blockFooterSize)
+	for i := 0; i < maxBoundaryBlockDistance && end >= int64(blockFooterSize); i++ {
+		_, err := r.Seek(end-int64(blockFooterSize), io.SeekStart)
+		if err != nil {
+			return 0, false
+		}
+		_, err = io.ReadFull(r, footer)
+		if err != nil || string(footer[12:]) != blockMagic {
+			return 0, false
+		}
+		typ := binary.LittleEndian.Uint32(footer[0:4])
+		size := binary.LittleEndian.Uint64(footer[4:12])
+		dataEnd := end - int64(blockFooterSize)
+		if size > uint64(dataEnd) {
+			return 0, false
+		}
+		if typ == blockBoundary && size == 8 {
+			_, err := r.Seek(dataEnd-8, io.SeekStart)
+			if err != nil {
+				return 0, false
+			}
+			data := make([]byte, 8)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return 0, false
+			}
+			off := binary.LittleEndian.Uint64(data)
+			return int64(off), off <= uint64(dataEnd)
+		}
+		end = dataEnd - int64(size)
+	}
+	return 0, false
+}
+
+func writeTrailingBlocks(w io.Writer, blocks []trailingBlock) error {
+	footer := make([]byte, blockFooterSize)
+	copy(footer[12:], blockMagic)
+	for _, b := range blocks {
+		_, err := w.Write(b.data)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(footer[0:4], b.typ)
+		binary.LittleEndian.PutUint64(footer[4:12], uint64(len(b.data)))
+		_, err = w.Write(footer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveTrailingBlocks returns the trailing blocks of an existing archive.
+func archiveTrailingBlocks(path string) ([]trailingBlock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bdyOff, found := locateBoundary(f, false)
+	if !found {
+		return nil, errors.New("not an archive")
+	}
+	_, payloadOff, payloadSize, err := readHeader(f, bdyOff)
+	if err != nil {
+		return nil, err
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return readTrailingBlocks(f, payloadOff+payloadSize, end)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// header returns the boundary, the key and the payload size of an archive,
+// as written after its stub.
+func header(size uint64) []byte {
+	buf := append(generateBoundary(), bytes.Repeat([]byte{1}, keyLength)...)
+	buf = append(buf, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(buf[len(buf)-8:], size)
+	return buf
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size uint64
+		err  string
+	}{
+		{"valid", 42, ""},
+		{"max", math.MaxInt64, ""},
+		{"above max", math.MaxInt64 + 1, "payload size out of range"},
+		{"max uint64", math.MaxUint64, "payload size out of range"},
+		{"placeholder", 0xdeadbeefdeadbeef, "invalid archive size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, off, size, err := readHeader(bytes.NewReader(header(tc.size)), 0)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(size) != tc.size || len(key) != keyLength || off != int64(len(header(0))) {
+				t.Errorf("got key %x, offset %d and size %d", key, off, size)
+			}
+		})
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	data := header(42)
+	_, _, _, err := readHeader(bytes.NewReader(data[:len(data)-3]), 0)
+	if err == nil {
+		t.Fatal("truncated header accepted")
+	}
+}
+
+// footer returns a block footer announcing size bytes of data.
+func footer(typ uint32, size uint64) []byte {
+	buf := make([]byte, blockFooterSize)
+	binary.LittleEndian.PutUint32(buf[0:4], typ)
+	binary.LittleEndian.PutUint64(buf[4:12], size)
+	copy(buf[12:], blockMagic)
+	return buf
+}
+
+func TestReadTrailingBlocks(t *testing.T) {
+	payload := []byte("payload")
+	var valid bytes.Buffer
+	want := []trailingBlock{{blockSettings, []byte(`{"exec":true}`)}, {blockHelp, []byte("help")}}
+	err := writeTrailingBlocks(&valid, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		blocks []byte
+		err    string
+	}{
+		{"valid", valid.Bytes(), ""},
+		{"none", nil, ""},
+		{"truncated footer", footer(blockHelp, 0)[3:], "truncated block footer"},
+		{"bad magic", append([]byte("data"), footer(blockHelp, 4)[:blockFooterSize-1]...), "no block magic"},
+		{"oversized", append([]byte("data"), footer(blockHelp, 1000)...), "overlaps the payload"},
+		{"above max int64", footer(blockHelp, math.MaxInt64+1), "overlaps the payload"},
+		{"max uint64", footer(blockHelp, math.MaxUint64), "overlaps the payload"},
+		{"overlapping payload", append([]byte("data"), footer(blockHelp, uint64(len(payload))+5)...), "overlaps the payload"},
+		{"truncated data", valid.Bytes()[4:], "overlaps the payload"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append(append([]byte(nil), payload...), tc.blocks...)
+			blocks, err := readTrailingBlocks(bytes.NewReader(data), int64(len(payload)), int64(len(data)))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.blocks != nil && !reflect.DeepEqual(blocks, want) {
+				t.Errorf("got blocks %v, want %v", blocks, want)
+			}
+		})
+	}
+}
+
+func TestReadLeadingBlocks(t *testing.T) {
+	payload := []byte("payload")
+	var valid bytes.Buffer
+	want := []trailingBlock{{blockSettings, []byte(`{"exec":true}`)}, {blockHelp, []byte("help " + blockMagic)}}
+	err := writeTrailingBlocks(&valid, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []trailingBlock
+	}{
+		{"blocks", valid.Bytes(), want},
+		{"data after the blocks", append(valid.Bytes(), "other archive"...), want},
+		{"block after the data", append(append([]byte("other"), valid.Bytes()...), "other"...), nil},
+		{"truncated footer", valid.Bytes()[:valid.Len()-1], want[:1]},
+		{"none", []byte("other archive"), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append(append([]byte(nil), payload...), tc.data...)
+			blocks := readLeadingBlocks(bytes.NewReader(data), int64(len(payload)), int64(len(data)))
+			if !reflect.DeepEqual(blocks, tc.want) {
+				t.Errorf("got blocks %v, want %v", blocks, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// runUsage counts the runs of archives created with -count-runs, so that
+// their commands can implement trials or first-use logic without storage of
+// their own. It is kept as JSON in the state dir of the user, under the name
+// given at creation, so that the versions of a product share their count.
+type runUsage struct {
+	Runs     int        `json:"runs"`
+	FirstRun *time.Time `json:"first_run,omitempty"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+}
+
+var usageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// checkUsageName reports names that can't name a file of the state dir.
+func checkUsageName(name string) error {
+	if !usageNamePattern.MatchString(name) {
+		return fmt.Errorf("%q must be made of letters, digits, '.', '_' and '-', and not start with '.'", name)
+	}
+	return nil
+}
+
+// usagePath returns the file counting the runs of the archives named name.
+func usagePath(name string) (string, error) {
+	dir, err := userStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "runs", name+".json"), nil
+}
+
+// countRun records the current run of the archive and exports the count and
+// the time of the previous run to the commands, once per run. Failures are
+// only warned about, the commands then run without the variables.
+func (se *selfExtractor) countRun() {
+	name := se.settings.CountRuns
+	if name == "" || se.runCounted {
+		return
+	}
+	se.runCounted = true
+	path, err := usagePath(name)
+	if err != nil {
+		warn("can't count runs:", err)
+		return
+	}
+	u, err := updateUsage(path, clock.Now())
+	if err != nil {
+		warn("can't count runs:", err)
+		return
+	}
+	debug("run", u.Runs, "recorded in", path)
+
+	os.Setenv(EnvRunCount, strconv.Itoa(u.Runs))
+	lastRun := ""
+	if u.LastRun != nil {
+		lastRun = u.LastRun.Format(time.RFC3339)
+	}
+	os.Setenv(EnvLastRun, lastRun)
+}
+
+// updateUsage counts a run at now in the file at path, and returns the usage
+// as it was before, with the run counted.
+func updateUsage(path string, now time.Time) (runUsage, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return runUsage{}, err
+	}
+	lock, err := lockPath(path)
+	if err != nil {
+		return runUsage{}, err
+	}
+	defer lock.unlock()
+
+	var u runUsage
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return runUsage{}, err
+	default:
+		err = json.Unmarshal(data, &u)
+		if err != nil {
+			warn("resetting run count, invalid", path+":", err)
+			u = runUsage{}
+		}
+	}
+
+	now = now.UTC().Truncate(time.Second)
+	next := u
+	next.Runs++
+	if next.FirstRun == nil {
+		next.FirstRun = &now
+	}
+	next.LastRun = &now
+
+	data, err = json.Marshal(next)
+	if err != nil {
+		return runUsage{}, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return runUsage{}, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return runUsage{}, err
+	}
+
+	u.Runs = next.Runs
+	return u, nil
+}
@@ -0,0 +1,44 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// verify checks that an archive can be extracted, like running it with
+// --selfextract-verify does.
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s verify [OPTION...] ARCHIVE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	verboseFlg := flags.Bool("v", false, "verbose output")
+	flags.Parse(args)
+	verbose = verbose || *verboseFlg
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name := flags.Arg(0)
+	f, err := os.Open(name)
+	if err != nil {
+		die("opening archive:", err)
+	}
+	defer f.Close()
+	payload, _, blocks := parseSelf(f)
+	if payload == nil {
+		die("not a selfextract archive:", name)
+	}
+
+	entries, err := verifyArchive(payload, blocks)
+	if err != nil {
+		die(err)
+	}
+	fmt.Printf("%s: OK, %d entries\n", name, entries)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	rdebug "runtime/debug"
+)
+
+// Build information of the tool, which can be set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...". When
+// unset, they're taken from what the Go toolchain embeds in the executable.
+var (
+	version string
+	commit  string
+	date    string
+)
+
+type buildInfo struct {
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Go      string `json:"go,omitempty"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, Date: date, Go: runtime.Version()}
+	bi, ok := rdebug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = s.Value
+		case s.Key == "vcs.time" && info.Date == "":
+			info.Date = s.Value
+		}
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	s := b.Version
+	if s == "" {
+		s = "unknown version"
+	}
+	if b.Commit != "" {
+		s += ", commit " + b.Commit
+	}
+	if b.Date != "" {
+		s += ", built " + b.Date
+	}
+	return s + ", " + b.Go
+}
+
+// buildInfoBlock records the build information of the creator in the archive,
+// so that artifacts can be traced back to the version of the tool that made
+// them.
+func buildInfoBlock() trailingBlock {
+	data, err := json.Marshal(currentBuildInfo())
+	if err != nil {
+		die("encoding build info:", err)
+	}
+	return trailingBlock{blockBuildInfo, data}
+}
+
+// creatorBuildInfo returns the build information of the tool that created the
+// archive, if it was recorded.
+func creatorBuildInfo(blocks []trailingBlock) (buildInfo, bool) {
+	var info buildInfo
+	for _, b := range blocks {
+		if b.typ == blockBuildInfo && json.Unmarshal(b.data, &info) == nil {
+			return info, true
+		}
+	}
+	return info, false
+}
+
+func (se *selfExtractor) printVersion() {
+	fmt.Println("stub:", currentBuildInfo())
+	fmt.Println("capabilities:", capabilityList())
+	if info, ok := creatorBuildInfo(se.blocks); ok {
+		fmt.Println("created by:", info)
+	}
+}
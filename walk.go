@@ -0,0 +1,112 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// walkOptions controls how input trees are walked in create mode.
+type walkOptions struct {
+	dereference bool // archive what symlinks point to instead of symlinks
+	maxDepth    int  // fail on deeper trees, if not zero
+}
+
+// walkInput walks the tree rooted at name, relative to root, like fs.WalkDir
+// does. It optionally follows symlinks, and fails with the looping path when
+// it would walk a directory inside itself, which can happen through symlinks
+// or bind mounts.
+func walkInput(root, name string, opts walkOptions, fn fs.WalkDirFunc) error {
+	w := inputWalker{root: root, opts: opts, fn: fn}
+	info, err := w.stat(name)
+	if err != nil {
+		return fn(name, nil, err)
+	}
+	return w.walk(name, fs.FileInfoToDirEntry(info), 0)
+}
+
+type inputWalker struct {
+	root  string
+	opts  walkOptions
+	fn    fs.WalkDirFunc
+	stack []ancestor // directories being walked
+}
+
+type ancestor struct {
+	path string
+	info fs.FileInfo
+}
+
+func (w *inputWalker) stat(name string) (fs.FileInfo, error) {
+	p := filepath.Join(w.root, filepath.FromSlash(name))
+	if w.opts.dereference {
+		info, err := os.Stat(p)
+		if err == nil {
+			return info, nil
+		}
+		// dangling symlinks are archived as is
+	}
+	return os.Lstat(p)
+}
+
+func (w *inputWalker) walk(name string, d fs.DirEntry, depth int) error {
+	err := w.fn(name, d, nil)
+	if err != nil || !d.IsDir() {
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	if w.opts.maxDepth > 0 && depth >= w.opts.maxDepth {
+		return fmt.Errorf("maximum depth of %d reached at %s", w.opts.maxDepth, name)
+	}
+
+	info, err := d.Info()
+	if err != nil {
+		return w.fn(name, d, err)
+	}
+	for i, a := range w.stack {
+		if os.SameFile(a.info, info) {
+			var loop []string
+			for _, a := range w.stack[i:] {
+				loop = append(loop, a.path)
+			}
+			return fmt.Errorf("directory loop: %s -> %s", strings.Join(loop, " -> "), name)
+		}
+	}
+	w.stack = append(w.stack, ancestor{name, info})
+	defer func() { w.stack = w.stack[:len(w.stack)-1] }()
+
+	entries, err := os.ReadDir(filepath.Join(w.root, filepath.FromSlash(name)))
+	if err != nil {
+		return w.fn(name, d, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		if w.opts.dereference && entry.Type()&fs.ModeSymlink != 0 {
+			info, err := w.stat(child)
+			if err != nil {
+				err = w.fn(child, entry, err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			entry = fs.FileInfoToDirEntry(info)
+		}
+		err = w.walk(child, entry, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// warningList collects the non-fatal problems of a run, so that they are
+// reported again at its end, where they're not lost among other messages,
+// and in the status file.
+type warningList struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+var warnings warningList
+
+func (w *warningList) add(v ...interface{}) {
+	w.mu.Lock()
+	w.msgs = append(w.msgs, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	w.mu.Unlock()
+}
+
+func (w *warningList) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.msgs...)
+}
+
+// reportWarnings prints a summary of the warnings of the run, if there were
+// several of them.
+func reportWarnings() {
+	msgs := warnings.list()
+	if len(msgs) < 2 {
+		return
+	}
+	log.Println(colorize(colorYellow, "selfextract: WARNING:"), len(msgs), "warnings:")
+	for _, msg := range msgs {
+		log.Println(colorize(colorYellow, "selfextract: WARNING:"), "  -", msg)
+	}
+}
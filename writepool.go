@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+)
+
+// writeWorkers is how many files are written at once when extracting.
+const writeWorkers = 8
+
+// pooledFileMax is the size of the largest files written by the workers, which
+// hold them in memory: bigger ones are written as they are decompressed.
+const pooledFileMax = 1 << 20
+
+// writePool writes extracted files concurrently with the decompression of the
+// following ones, which hides the latency of creating many small files. The
+// writes of a same path are kept in order: a path is claimed before being
+// written, which waits for its pending write, if any.
+type writePool struct {
+	work chan func() error
+	wg   sync.WaitGroup // pending writes
+
+	mu       sync.Mutex
+	firstErr error
+
+	// paths written since the last wait, only used by the submitter
+	pending map[string]bool
+}
+
+func newWritePool(workers int) *writePool {
+	p := &writePool{
+		work:    make(chan func() error),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for write := range p.work {
+				err := write()
+				if err != nil {
+					p.mu.Lock()
+					if p.firstErr == nil {
+						p.firstErr = err
+					}
+					p.mu.Unlock()
+				}
+				p.wg.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// claim waits for the pending write of path, if any, before it is written
+// again or read.
+func (p *writePool) claim(path string) {
+	if p.pending[path] {
+		p.wait()
+	}
+}
+
+// submit writes path with write, once a worker is free.
+func (p *writePool) submit(path string, write func() error) {
+	p.claim(path)
+	p.pending[path] = true
+	p.wg.Add(1)
+	p.work <- write
+}
+
+// err returns the first error of the writes so far.
+func (p *writePool) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.firstErr
+}
+
+// wait waits for the pending writes, and returns the first error of the
+// writes so far.
+func (p *writePool) wait() error {
+	p.wg.Wait()
+	p.pending = make(map[string]bool)
+	return p.err()
+}
+
+// close waits for the pending writes and stops the workers.
+func (p *writePool) close() error {
+	err := p.wait()
+	close(p.work)
+	return err
+}
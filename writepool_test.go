@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractWriteOrder(t *testing.T) {
+	file := func(name, data string) tarEntry {
+		return tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}, data}
+	}
+	link := func(typ byte, name, target string) tarEntry {
+		return tarEntry{&tar.Header{Typeflag: typ, Name: name, Linkname: target, Mode: 0777}, ""}
+	}
+	large := strings.Repeat("l", pooledFileMax+1)
+	// the pooled writes race with the following entries, many entries make
+	// the writes out of order likely to show
+	var rewrites, links []tarEntry
+	wantLinks := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		rewrites = append(rewrites, file("a", strings.Repeat("a", 1000-i)))
+		name := fmt.Sprint("f", i)
+		links = append(links, file(name, name), link(tar.TypeLink, name+".link", name))
+		wantLinks[name+".link"] = name
+	}
+
+	for _, tc := range []struct {
+		name     string
+		merge    bool
+		existing map[string]string
+		entries  []tarEntry
+		want     map[string]string // contents of the files read through their path
+		links    map[string]string // targets of the symlinks
+		fatal    string
+	}{
+		{
+			name:     "file rewritten when merging",
+			merge:    true,
+			existing: map[string]string{"a": "old", "b": "old"},
+			entries:  append(rewrites, file("b", "first"), file("b", large)),
+			want:     map[string]string{"a": strings.Repeat("a", 901), "b": large},
+		},
+		{
+			name:    "pooled file rewriting a large one",
+			entries: []tarEntry{file("a", large), file("a", "second")},
+			want:    map[string]string{"a": "second"},
+		},
+		{
+			name:    "hard links to pooled files",
+			entries: links,
+			want:    wantLinks,
+		},
+		{
+			name:    "symlink after pooled writes",
+			merge:   true,
+			entries: []tarEntry{file("d/f", "data"), file("a", "file"), link(tar.TypeSymlink, "l", "d"), link(tar.TypeSymlink, "a", "d/f")},
+			want:    map[string]string{"l/f": "data", "a": "data"},
+			links:   map[string]string{"l": "d", "a": "d/f"},
+		},
+		{
+			name:    "error of a pooled write",
+			entries: []tarEntry{file("p", "file"), file("p/f", "file")},
+			fatal:   "creating file:",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tc.existing {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			se := &selfExtractor{payload: bytes.NewReader(buildTar(t, tc.entries)), extractDir: dir, merge: tc.merge}
+			fatal := catchDie(se.extract)
+			if tc.fatal != "" {
+				if !strings.Contains(fatal, tc.fatal) {
+					t.Fatalf("got fatal error %q, want %q", fatal, tc.fatal)
+				}
+				entries, err := os.ReadDir(dir)
+				if err != nil || len(entries) != 0 {
+					t.Errorf("extraction dir not cleaned up: %v %v", entries, err)
+				}
+				return
+			}
+			if fatal != "" {
+				t.Fatal(fatal)
+			}
+
+			for name, want := range tc.want {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != want {
+					t.Errorf("%s has %d bytes %.10q, want %d bytes %.10q", name, len(data), data, len(want), want)
+				}
+			}
+			for name, want := range tc.links {
+				target, err := os.Readlink(filepath.Join(dir, name))
+				if err != nil || target != want {
+					t.Errorf("%s points to %q, want %q: %v", name, target, want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"archive/tar"
+	"sort"
+	"strings"
+)
+
+// xattrRecordPrefix starts the PAX records of the extended attributes of the
+// entries, as written by GNU tar and bsdtar.
+const xattrRecordPrefix = "SCHILY.xattr."
+
+// skippedXattrs are the extended attributes not archived, which belong to the
+// system the files come from.
+var skippedXattrs = map[string]bool{"security.selinux": true}
+
+// restoreXattrs gives an extracted entry the extended attributes recorded in
+// the archive, including file capabilities and POSIX ACLs. It comes after
+// changing its owner, which clears the file capabilities.
+func (se *selfExtractor) restoreXattrs(path string, hdr *tar.Header) {
+	var names []string
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrRecordPrefix) {
+			names = append(names, strings.TrimPrefix(k, xattrRecordPrefix))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := setXattr(path, name, []byte(hdr.PAXRecords[xattrRecordPrefix+name]))
+		if err != nil {
+			warn("could not restore extended attribute", name, "of", path+":", err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+)
+
+var errNoXattrs = errors.New("extended attributes not supported on this platform")
+
+func listXattrs(path string) (map[string]string, error) {
+	return nil, errNoXattrs
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errNoXattrs
+}
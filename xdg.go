@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Persistent files of selfextract go to the per-user directories of the
+// platform, in a selfextract subdirectory, so that they follow the XDG base
+// directory specification on Unix (XDG_CACHE_HOME, XDG_STATE_HOME) and its
+// equivalents on Windows and macOS.
+
+// userCacheDir returns the directory of files that can be deleted at any time.
+func userCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "selfextract"), nil
+}
+
+// userStateDir returns the directory of data that must persist between runs,
+// but isn't worth backing up.
+func userStateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	switch {
+	case runtime.GOOS == "windows":
+		dir = os.Getenv("LocalAppData")
+	case runtime.GOOS == "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, "Library", "Application Support")
+	case dir == "" || !filepath.IsAbs(dir):
+		// the specification requires ignoring relative paths
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	if dir == "" {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(dir, "selfextract"), nil
+}
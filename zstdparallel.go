@@ -0,0 +1,88 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minZstdChunkSize is the size of the chunks of the payload compressed
+// concurrently, unless the compression window is larger.
+const minZstdChunkSize = 4 << 20
+
+// parallelZstdWriter compresses what is written to it on several threads, by
+// cutting it into chunks compressed as independent zstd frames, which are
+// written in order. Decompressors read the frames one after the other as a
+// single stream.
+type parallelZstdWriter struct {
+	w         io.Writer
+	enc       *zstd.Encoder
+	jobs      int
+	chunkSize int
+
+	buf     []byte
+	pending []chan []byte // frames being compressed, in order
+	written bool          // whether a frame was started
+	err     error
+}
+
+func newParallelZstdWriter(w io.Writer, enc *zstd.Encoder, jobs, chunkSize int) *parallelZstdWriter {
+	return &parallelZstdWriter{w: w, enc: enc, jobs: jobs, chunkSize: chunkSize}
+}
+
+func (z *parallelZstdWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && z.err == nil {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, z.chunkSize)
+		}
+		c := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+		n += c
+		if len(z.buf) == cap(z.buf) {
+			z.compressChunk()
+		}
+	}
+	return n, z.err
+}
+
+// compressChunk starts compressing the buffered data, after waiting for the
+// oldest frame to write when all the threads are busy.
+func (z *parallelZstdWriter) compressChunk() {
+	if len(z.pending) == z.jobs {
+		z.writeFrame()
+	}
+	chunk := z.buf
+	z.buf = nil
+	frame := make(chan []byte, 1)
+	go func() {
+		frame <- z.enc.EncodeAll(chunk, nil)
+	}()
+	z.pending = append(z.pending, frame)
+	z.written = true
+}
+
+// writeFrame writes the oldest frame once compressed.
+func (z *parallelZstdWriter) writeFrame() {
+	frame := <-z.pending[0]
+	z.pending = z.pending[1:]
+	if z.err == nil {
+		_, z.err = z.w.Write(frame)
+	}
+}
+
+// Close compresses what is left and writes all the frames. It does not close
+// the underlying writer.
+func (z *parallelZstdWriter) Close() error {
+	// even empty payloads are a frame, with an encoder writing zero frames
+	if len(z.buf) > 0 || !z.written {
+		z.compressChunk()
+	}
+	for len(z.pending) > 0 {
+		z.writeFrame()
+	}
+	return z.err
+}
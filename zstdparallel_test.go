@@ -0,0 +1,111 @@
+//go:build !stubonly
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// failingWriter fails once more than limit bytes were written to it.
+type failingWriter struct {
+	limit int
+	n     int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		return 0, errWriteFailed
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestParallelZstdWriter(t *testing.T) {
+	const chunkSize = 1024
+	enc, err := zstd.NewWriter(nil, zstd.WithZeroFrames(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		rnd.Read(data)
+		return data
+	}
+
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		jobs  int
+		write int // size of the writes, all at once if zero
+	}{
+		{"empty", nil, 2, 0},
+		{"less than a chunk", random(100), 2, 0},
+		{"one chunk", random(chunkSize), 2, 0},
+		{"multiple of the chunk size", random(3 * chunkSize), 2, 0},
+		{"more jobs than chunks", random(2*chunkSize + 10), 8, 0},
+		{"more chunks than jobs", random(10*chunkSize + 10), 3, 0},
+		{"small writes", random(5*chunkSize + 10), 2, 100},
+		{"one job", random(3*chunkSize + 10), 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			z := newParallelZstdWriter(&buf, enc, tc.jobs, chunkSize)
+			data := tc.data
+			for len(data) > 0 {
+				size := len(data)
+				if tc.write > 0 && tc.write < size {
+					size = tc.write
+				}
+				n, err := z.Write(data[:size])
+				if err != nil || n != size {
+					t.Fatalf("wrote %d bytes out of %d: %v", n, size, err)
+				}
+				data = data[size:]
+			}
+			err := z.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := newDecompressor(bytes.NewReader(buf.Bytes()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Errorf("got %d bytes back, want %d", len(got), len(tc.data))
+			}
+		})
+	}
+
+	t.Run("write error", func(t *testing.T) {
+		w := &failingWriter{limit: chunkSize}
+		z := newParallelZstdWriter(w, enc, 2, chunkSize)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = z.Write(random(chunkSize))
+		}
+		if !errors.Is(err, errWriteFailed) {
+			t.Errorf("got write error %v, want %v", err, errWriteFailed)
+		}
+		err = z.Close()
+		if !errors.Is(err, errWriteFailed) {
+			t.Errorf("got close error %v, want %v", err, errWriteFailed)
+		}
+	})
+}